@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	adminBridgesPrefix = "/admin/bridges/"
+)
+
+// ReloadResponse is the response to a request to reload our bridges.
+type ReloadResponse struct {
+	Bridges int `json:"bridges"`
+	// Stale is the number of bridges that we excluded because BridgeDB
+	// didn't see them within our freshness window.
+	Stale int `json:"stale"`
+	// Sources tells the operator what we skipped in each of our sources.
+	Sources []*SourceReport `json:"sources,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// SourceReport tells the operator what we skipped in one of the sources that
+// we reloaded bridges from.
+type SourceReport struct {
+	File string `json:"file"`
+	// Skipped is the number of malformed lines (or rows, for BridgeDB's
+	// database) that we skipped.
+	Skipped int `json:"skipped"`
+	// SkippedPerBridge maps a bridge's fingerprint to the number of lines
+	// in its descriptor that we skipped.  Like in ParseReport, the empty
+	// fingerprint counts lines outside of any (well-formed) descriptor.
+	SkippedPerBridge map[string]int `json:"skipped_per_bridge,omitempty"`
+	// Errors contains at most MaxLoggedParseErrors of the reasons why we
+	// skipped lines, so a thoroughly broken file doesn't bloat our
+	// response.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// NewReloadResponse returns the response to a successful reload of the given
+// number of bridges, with the given report of what we skipped.
+func NewReloadResponse(n int, report *LoadReport) *ReloadResponse {
+
+	resp := &ReloadResponse{Bridges: n, Stale: report.Database.Stale}
+	resp.Sources = append(resp.Sources, newSourceReport(report.SqliteFile, report.Database.Errors, nil))
+
+	var files []string
+	for f := range report.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		var errs []error
+		for _, err := range report.Files[f].Errors {
+			errs = append(errs, err)
+		}
+		resp.Sources = append(resp.Sources, newSourceReport(f, errs, report.Files[f].Skipped))
+	}
+	return resp
+}
+
+// newSourceReport returns the report of the given file, in which we skipped
+// lines because of the given errors.
+func newSourceReport(file string, errs []error, skipped map[string]int) *SourceReport {
+
+	r := &SourceReport{File: file, Skipped: len(errs), SkippedPerBridge: skipped}
+	for i, err := range errs {
+		if i == MaxLoggedParseErrors {
+			break
+		}
+		r.Errors = append(r.Errors, err.Error())
+	}
+	return r
+}
+
+// TransportDetails represents one of a bridge's transports, as shown by our
+// admin API.
+type TransportDetails struct {
+	ID         string              `json:"id"`
+	Type       string              `json:"type"`
+	Protocol   string              `json:"protocol"`
+	Address    IPAddr              `json:"address"`
+	Port       uint16              `json:"port"`
+	Parameters map[string][]string `json:"params,omitempty"`
+	BlockedIn  []*Location         `json:"blocked_in"`
+}
+
+// BridgeDetails represents everything we know about a bridge, as shown by our
+// admin API.  Unlike Bridge's JSON encoding, which we use to hand out bridges,
+// it includes our internal state.
+type BridgeDetails struct {
+	ID          string               `json:"id"`
+	Fingerprint string               `json:"fingerprint"`
+	Distributor string               `json:"distributor"`
+	Address     IPAddr               `json:"address"`
+	Port        uint16               `json:"port"`
+	FirstSeen   time.Time            `json:"first_seen"`
+	LastSeen    time.Time            `json:"last_seen"`
+	BlockedIn   []*Location          `json:"blocked_in"`
+	LastTested  map[string]time.Time `json:"last_tested"`
+	Transports  []*TransportDetails  `json:"transports"`
+	Usage       *BridgeUsage         `json:"usage"`
+	Flags       []string             `json:"flags"`
+	ORAddresses []*ORAddress         `json:"or_addresses"`
+	// DistributionRequest is the distribution method that the bridge's
+	// operator requested.
+	DistributionRequest string `json:"distribution_request"`
+	// SuspectedBlockedIn contains the countries in which the bridge's usage
+	// dropped.
+	SuspectedBlockedIn []string `json:"suspected_blocked_in"`
+}
+
+// NewBridgeDetails returns the details of the given bridge, whose IDs we derive
+// from the given configuration.  The caller must
+// hold the lock of the bridge's set of bridges.  The details don't share the
+// state that new results modify, so the caller may release the lock before
+// encoding them.
+func NewBridgeDetails(cfg *ConfigFile, b *Bridge) *BridgeDetails {
+
+	d := &BridgeDetails{
+		ID:                  b.GetID(cfg),
+		Fingerprint:         b.Fingerprint,
+		Distributor:         b.Distributor,
+		Address:             b.Address,
+		Port:                b.Port,
+		FirstSeen:           b.FirstSeen,
+		LastSeen:            b.LastSeen,
+		BlockedIn:           b.BlockedIn,
+		LastTested:          make(map[string]time.Time, len(b.LastTested)),
+		Transports:          []*TransportDetails{},
+		Usage:               b.Usage,
+		Flags:               b.Flags,
+		ORAddresses:         b.ORAddresses,
+		DistributionRequest: b.DistributionRequest,
+		// We return an empty list rather than null.
+		SuspectedBlockedIn: append([]string{}, b.SuspectedBlockedIn...),
+	}
+	for country, t := range b.LastTested {
+		d.LastTested[country] = t
+	}
+	for _, t := range b.Transports {
+		d.Transports = append(d.Transports, &TransportDetails{
+			ID:         t.GetID(cfg),
+			Type:       t.Type,
+			Protocol:   t.Protocol,
+			Address:    t.Address,
+			Port:       t.Port,
+			Parameters: t.Parameters,
+			BlockedIn:  t.BlockedIn,
+		})
+	}
+	return d
+}
+
+// isAdminRequest returns 'true' if the given HTTP request carries an
+// authentication token that the given configuration considers valid, and that
+// grants access to our admin API.  If not, we respond with an error.
+func isAdminRequest(cfg *ConfigFile, w http.ResponseWriter, r *http.Request) bool {
+
+	authToken, err := extractAuthToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	t, ok := getApiToken(cfg, authToken)
+	if !ok {
+		log.Printf("Received admin request with invalid authentication token.")
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return false
+	}
+	setOrganisation(w, t.Organisation)
+	if !t.Admin {
+		log.Printf("Organisation %q may not use the admin API.", t.Organisation)
+		http.Error(w, "token may not use the admin API", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes the given object as JSON, with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+
+	json, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, string(json))
+}
+
+// AdminReloadHandler reloads our bridges right away, and responds with the
+// number of bridges that we loaded and what we skipped in our sources, or with
+// the reason why the reload failed.
+func AdminReloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "reloads must be requested via POST", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := getConfig()
+	if !isAdminRequest(cfg, w, r) {
+		return
+	}
+
+	n, report, err := reloader.Reload(r.Context())
+	if err != nil {
+		log.Printf("Failed to reload bridges on demand: %s", err)
+		writeJSON(w, http.StatusInternalServerError, &ReloadResponse{Error: err.Error()})
+		return
+	}
+	log.Printf("Successfully loaded %d bridges on demand.", n)
+	writeJSON(w, http.StatusOK, NewReloadResponse(n, report))
+}
+
+// AdminBridgeHandler responds with everything we know about the bridge whose
+// fingerprint is in the URL path, e.g., /admin/bridges/A0EC5B0F....
+func AdminBridgeHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "bridges must be requested via GET", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := getConfig()
+	if !isAdminRequest(cfg, w, r) {
+		return
+	}
+
+	fingerprint := strings.ToUpper(strings.TrimPrefix(r.URL.Path, adminBridgesPrefix))
+	if fingerprint == "" {
+		http.Error(w, "no fingerprint given", http.StatusBadRequest)
+		return
+	}
+
+	// We copy the bridge's details while holding the lock, so a concurrent
+	// verdict update cannot modify them underneath us, but we don't hold the
+	// lock while writing to a possibly slow client.
+	bridges.m.Lock()
+	var d *BridgeDetails
+	if b, ok := bridges.Bridges[fingerprint]; ok {
+		d = NewBridgeDetails(cfg, b)
+	}
+	bridges.m.Unlock()
+	if d == nil {
+		http.Error(w, fmt.Sprintf("no bridge with fingerprint %s", fingerprint), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
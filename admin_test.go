@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandlers(t *testing.T) {
+
+	adminToken := "KEWDlzJ7JLCBZ2dJ6pXa4P04aq0rbi1weJXGBAP0H/o="
+	userToken := "FuoP6JeXetoEmwD2jB0Nc3ip2MlEdD/ESa30ML0NaZE="
+	setConfig(&ConfigFile{
+		ApiTokens: []ApiToken{
+			ApiToken{Organisation: "ops", Token: adminToken, Admin: true},
+			ApiToken{Organisation: "foo", Token: userToken},
+		},
+		SqliteFile:    "/nonexistent/bridges.sqlite",
+		ExtrainfoFile: "/nonexistent/cached-extrainfo",
+	})
+
+	fingerprint := "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"
+	bs := newTestBridges(fingerprint)
+	b := bs.Bridges[fingerprint]
+	b.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	b.Port = 443
+	b.BlockedIn = []*Location{&Location{Country: "ru"}}
+	obfs4 := NewTransport()
+	obfs4.Type = BridgeTypeObfs4
+	obfs4.Address = b.Address
+	obfs4.Port = 1234
+	b.AddTransport(obfs4)
+	bridges.Update(bs)
+
+	do := func(h http.HandlerFunc, method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	w := do(AdminBridgeHandler, "GET", adminBridgesPrefix+fingerprint, userToken)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code %d for non-admin token but got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = do(AdminBridgeHandler, "GET", adminBridgesPrefix+"0000000000000000000000000000000000000000", adminToken)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d for unknown bridge but got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = do(AdminBridgeHandler, "GET", adminBridgesPrefix+"a0ec5b0fc51a5cd800b9d1d16d325636b5755bce", adminToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+	}
+	var d struct {
+		Fingerprint string
+		Distributor string
+		Port        uint16
+		BlockedIn   []*Location `json:"blocked_in"`
+		Transports  []struct {
+			ID   string
+			Type string
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatalf("failed to unmarshal bridge details: %s", err)
+	}
+	if d.Fingerprint != fingerprint || d.Distributor != DistributorUnallocated || d.Port != 443 {
+		t.Errorf("unexpected bridge details: %+v", d)
+	}
+	if len(d.BlockedIn) != 1 || d.BlockedIn[0].Country != "ru" {
+		t.Errorf("unexpected locations in which bridge is blocked: %v", d.BlockedIn)
+	}
+	if len(d.Transports) != 1 || d.Transports[0].Type != BridgeTypeObfs4 || d.Transports[0].ID != obfs4.GetID(getConfig()) {
+		t.Errorf("unexpected transports: %+v", d.Transports)
+	}
+
+	// Only admin tokens may export the bridges that we consider blocked.
+	w = do(BlockedHandler, "GET", "/blocked", userToken)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status code %d for non-admin token but got %d", http.StatusForbidden, w.Code)
+	}
+	w = do(BlockedHandler, "GET", "/blocked?format=bridgedb", adminToken)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), fingerprint) {
+		t.Errorf("failed to export blocked bridges: %d %q", w.Code, w.Body.String())
+	}
+
+	w = do(AdminReloadHandler, "GET", "/admin/reload", adminToken)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status code %d for GET request but got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	// Our sources don't exist, so the reload fails, and we keep our bridges.
+	w = do(AdminReloadHandler, "POST", "/admin/reload", adminToken)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %d for failed reload but got %d", http.StatusInternalServerError, w.Code)
+	}
+	var resp ReloadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal reload response: %s", err)
+	}
+	if resp.Error == "" {
+		t.Error("reload response lacks error")
+	}
+	if len(bridges.Bridges) != 1 {
+		t.Error("failed reload must keep our old bridges")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog records which bridges we handed out to whom.
+var auditLog = &AuditLog{}
+
+// AuditEntry represents a bridge (or transport) that we handed out to a
+// client.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Organisation string    `json:"organisation"`
+	TokenID      string    `json:"token_id,omitempty"`
+	ClientID     string    `json:"client_id"`
+	ProbeType    string    `json:"probe_type"`
+	Country      string    `json:"country_code"`
+	Fingerprint  string    `json:"fingerprint"`
+	Transport    string    `json:"transport"`
+	BridgeID     string    `json:"bridge_id"`
+}
+
+// AuditLog writes AuditEntry objects as JSON lines to the file that's
+// configured as audit_log_file.  If no file is configured, we discard
+// entries.
+type AuditLog struct {
+	m    sync.Mutex
+	path string
+	file *os.File
+}
+
+// Log writes the given entries to our audit log.
+func (l *AuditLog) Log(entries []*AuditEntry) error {
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	path := getConfig().AuditLogFile
+	if path != l.path {
+		l.close()
+		l.path = path
+	}
+	if l.path == "" {
+		return nil
+	}
+	if l.file == nil {
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+
+	// We write each entry with a single call, so entries don't get mangled
+	// if somebody else appends to the file.
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err = l.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes our audit log file.  We re-open it when writing the next
+// entry, which allows for rotating the file.
+func (l *AuditLog) Close() {
+
+	l.m.Lock()
+	l.close()
+	l.m.Unlock()
+}
+
+// close closes our audit log file.  The caller must hold the lock.
+func (l *AuditLog) close() {
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
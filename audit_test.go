@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	l := &AuditLog{}
+	defer l.Close()
+
+	// Without an audit log file, we discard entries.
+	setConfig(&ConfigFile{})
+	if err := l.Log([]*AuditEntry{&AuditEntry{Organisation: "foo"}}); err != nil {
+		t.Fatalf("failed to discard entry: %s", err)
+	}
+
+	setConfig(&ConfigFile{AuditLogFile: filename})
+	now := time.Now().UTC().Truncate(time.Second)
+	entries := []*AuditEntry{
+		&AuditEntry{Time: now, Organisation: "foo", TokenID: "0123", ClientID: "1234",
+			ProbeType: "ooni", Country: "ru", Fingerprint: "A0EC", Transport: "obfs4", BridgeID: "abcd"},
+		&AuditEntry{Time: now, Organisation: "foo", ClientID: "1234",
+			ProbeType: "ooni", Country: "ru", Fingerprint: "A0EC", Transport: "vanilla", BridgeID: "efgh"},
+	}
+	if err := l.Log(entries[:1]); err != nil {
+		t.Fatalf("failed to log entry: %s", err)
+	}
+	// Closing the log (e.g., after rotating it) must not lose entries.
+	l.Close()
+	if err := l.Log(entries[1:]); err != nil {
+		t.Fatalf("failed to log entry: %s", err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %s", err)
+	}
+	defer f.Close()
+	var got []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			t.Fatalf("failed to unmarshal audit log line: %s", err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("expected %d entries but got %d", len(entries), len(got))
+	}
+	for i := range entries {
+		if *got[i] != *entries[i] {
+			t.Errorf("expected entry %+v but got %+v", entries[i], got[i])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -27,6 +29,10 @@ const (
 	DistributorUnallocated = "unallocated"
 
 	BridgeReloadInterval = time.Hour
+
+	// MaxLoggedParseErrors is the maximum number of errors that we log when
+	// parsing a descriptor document.
+	MaxLoggedParseErrors = 10
 )
 
 // bridges holds all of our bridges.
@@ -47,18 +53,69 @@ func (a IPAddr) MarshalJSON() ([]byte, error) {
 type Bridges struct {
 	m       sync.Mutex
 	Bridges map[string]*Bridge
+	// byID maps the IDs of our bridges and their transports to the bridge
+	// and (for a transport's ID) the transport, so FindByID doesn't have to
+	// compute every ID.  idKey is the master key that we computed the IDs
+	// with.
+	byID  map[string]idEntry
+	idKey string
+}
+
+// idEntry is what an ID in our ID index belongs to: a bridge, or one of a
+// bridge's transports.
+type idEntry struct {
+	bridge    *Bridge
+	transport *Transport
 }
 
-// Update allows us to update our set of bridges.
+// Update allows us to update our set of bridges.  We index the new bridges'
+// IDs before taking the lock, so requests don't have to wait for that.
 func (old *Bridges) Update(new *Bridges) {
+	new.indexIDs(getConfig())
 	old.m.Lock()
 	old.Bridges = new.Bridges
+	old.byID, old.idKey = new.byID, new.idKey
 	old.m.Unlock()
 }
 
 // Add adds the given bridge to the set of bridges.
 func (bs *Bridges) Add(b *Bridge) {
 	bs.Bridges[b.Fingerprint] = b
+	bs.byID = nil
+}
+
+// indexIDs computes the IDs of all of our bridges and their transports with
+// the given configuration's master key, and indexes them for FindByID.
+func (bs *Bridges) indexIDs(cfg *ConfigFile) {
+
+	bs.byID = make(map[string]idEntry)
+	bs.idKey = cfg.MasterKey
+	for _, b := range bs.Bridges {
+		bs.byID[b.GetID(cfg)] = idEntry{bridge: b}
+	}
+	// A bridge's own ID takes precedence over a transport's.
+	for _, b := range bs.Bridges {
+		for _, t := range b.Transports {
+			id := t.GetID(cfg)
+			if _, ok := bs.byID[id]; !ok {
+				bs.byID[id] = idEntry{bridge: b, transport: t}
+			}
+		}
+	}
+}
+
+// FindByID returns the bridge whose ID (see GetID) matches the given ID.  If
+// the ID belongs to one of the bridge's transports, we return the transport as
+// well.  If we have no bridge with the given ID, both return values are nil.
+// We look the ID up in our ID index, which we rebuild if the master key
+// changed since we built it.  The caller must hold the lock.
+func (bs *Bridges) FindByID(cfg *ConfigFile, id string) (*Bridge, *Transport) {
+
+	if bs.byID == nil || bs.idKey != cfg.MasterKey {
+		bs.indexIDs(cfg)
+	}
+	e := bs.byID[id]
+	return e.bridge, e.transport
 }
 
 // NewBridges allocates and returns a new Bridges object.
@@ -71,8 +128,47 @@ func NewBridges() *Bridges {
 // Location represents a location in which a bridge is blocked.  This is either
 // a two-letter country code or an AS number.
 type Location struct {
-	Country string // An ISO 3166-1 alpha-2 country code.
-	ASN     int    // An autonomous system number.
+	Country string `json:"country_code,omitempty"` // An ISO 3166-1 alpha-2 country code.
+	ASN     int    `json:"asn,omitempty"`          // An autonomous system number.
+}
+
+// Equals returns 'true' if the two given locations are identical.
+func (l1 *Location) Equals(l2 *Location) bool {
+	return l1.Country == l2.Country && l1.ASN == l2.ASN
+}
+
+// isBlockedIn returns 'true' if any of the given locations is in the given
+// country.
+func isBlockedIn(ls []*Location, country string) bool {
+	for _, l := range ls {
+		if l.Country == country {
+			return true
+		}
+	}
+	return false
+}
+
+// addLocation adds the given location to the given slice of locations unless
+// it's already in there, and returns the resulting slice.
+func addLocation(ls []*Location, l *Location) []*Location {
+	for _, l2 := range ls {
+		if l.Equals(l2) {
+			return ls
+		}
+	}
+	return append(ls, l)
+}
+
+// removeLocation removes the given location from the given slice of
+// locations, and returns the resulting slice.
+func removeLocation(ls []*Location, l *Location) []*Location {
+	var newLs []*Location
+	for _, l2 := range ls {
+		if !l.Equals(l2) {
+			newLs = append(newLs, l2)
+		}
+	}
+	return newLs
 }
 
 // Bridge represents a Tor bridge.
@@ -87,6 +183,27 @@ type Bridge struct {
 	LastSeen    time.Time    `json:"-"`
 	BlockedIn   []*Location  `json:"-"`
 	Transports  []*Transport `json:"-"`
+	// LastTested maps a country code to the time at which a client in the
+	// given country last tested the bridge or one of its transports.
+	LastTested map[string]time.Time `json:"-"`
+	// Usage contains the usage statistics from the bridge's most recent
+	// extra-info descriptor, if any.
+	Usage *BridgeUsage `json:"-"`
+	// SuspectedBlockedIn contains the countries in which the bridge's usage
+	// collapsed, which suggests that the bridge is blocked there.  Unlike
+	// BlockedIn, it's based on passive measurements only.
+	SuspectedBlockedIn []string `json:"-"`
+	// Flags contains the flags (e.g., "Running") that the bridge authority
+	// assigned to the bridge.  It's nil if we don't know the bridge's flags,
+	// e.g., because we have no networkstatus document.
+	Flags []string `json:"-"`
+	// ORAddresses contains the bridge's additional ORPorts, e.g., its IPv6
+	// ORPort.
+	ORAddresses []*ORAddress `json:"-"`
+	// DistributionRequest is the distribution method (e.g., "moat" or
+	// "none") that the bridge's operator requested in the bridge's server
+	// descriptor.  It's empty if we don't know.
+	DistributionRequest string `json:"-"`
 }
 
 // String returns a string representation of the bridge.
@@ -102,9 +219,105 @@ func NewBridge() *Bridge {
 	// over TCP.
 	b.Protocol = ProtoTypeTCP
 	b.Type = BridgeTypeVanilla
+	b.LastTested = make(map[string]time.Time)
 	return b
 }
 
+// IsBlockedIn returns 'true' if the bridge's vanilla ORPort is blocked in the
+// given country.  We only consider country-wide verdicts because blocked
+// autonomous systems are locations of their own, without a country.
+func (b *Bridge) IsBlockedIn(country string) bool {
+	return isBlockedIn(b.BlockedIn, country)
+}
+
+// HasFlag returns 'true' if the bridge authority assigned the given flag to
+// the bridge.
+func (b *Bridge) HasFlag(flag string) bool {
+
+	for _, f := range b.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRunning returns 'true' unless the bridge authority considers the bridge
+// not running.  If we don't know the bridge's flags, we assume that it's
+// running.
+func (b *Bridge) IsRunning() bool {
+	return b.Flags == nil || b.HasFlag(FlagRunning)
+}
+
+// OptedOut returns 'true' if the bridge's operator requested that the bridge
+// isn't distributed at all, in which case we don't hand it out for testing
+// either.
+func (b *Bridge) OptedOut() bool {
+	return b.DistributionRequest == DistributionRequestNone
+}
+
+// addORAddress adds the given additional ORPort to the bridge, unless the
+// bridge already has it.
+func (b *Bridge) addORAddress(a *ORAddress) {
+
+	for _, existing := range b.ORAddresses {
+		if existing.Address.IP.Equal(a.Address.IP) && existing.Port == a.Port {
+			return
+		}
+	}
+	b.ORAddresses = append(b.ORAddresses, a)
+}
+
+// AsTransport returns a transport of type "vanilla" that represents the
+// bridge's ORPort.  The transport has the same ID as the bridge.
+func (b *Bridge) AsTransport() *Transport {
+	return &Transport{
+		Type:        b.Type,
+		Protocol:    b.Protocol,
+		Address:     b.Address,
+		Port:        b.Port,
+		Fingerprint: b.Fingerprint,
+		Bridge:      b,
+		BlockedIn:   b.BlockedIn,
+	}
+}
+
+// Copy returns a copy of the bridge, including copies of its transports.  The
+// copy doesn't share the state that we modify when clients submit results, so
+// callers may use it after releasing the lock of the bridge's set of bridges.
+func (b *Bridge) Copy() *Bridge {
+
+	c := *b
+	c.LastTested = make(map[string]time.Time, len(b.LastTested))
+	for country, t := range b.LastTested {
+		c.LastTested[country] = t
+	}
+	c.Transports = nil
+	for _, t := range b.Transports {
+		tc := *t
+		tc.Bridge = &c
+		c.Transports = append(c.Transports, &tc)
+	}
+	return &c
+}
+
+// TestableTransports returns the bridge's vanilla ORPort (as a transport) and
+// all of its pluggable transports, except those that are blocked in the given
+// country.
+func (b *Bridge) TestableTransports(country string) []*Transport {
+
+	var ts []*Transport
+	if !b.IsBlockedIn(country) {
+		ts = append(ts, b.AsTransport())
+	}
+	for _, t := range b.Transports {
+		if !t.IsBlockedIn(country) {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
 // AddTransport adds the given transport to the bridge.
 func (b *Bridge) AddTransport(t1 *Transport) {
 	for _, t2 := range b.Transports {
@@ -116,62 +329,252 @@ func (b *Bridge) AddTransport(t1 *Transport) {
 	b.Transports = append(b.Transports, t1)
 }
 
+// GetTransport returns the bridge's transport of the given type, or nil if the
+// bridge has no such transport.
+func (b *Bridge) GetTransport(transportType string) *Transport {
+	for _, t := range b.Transports {
+		if t.Type == transportType {
+			return t
+		}
+	}
+	return nil
+}
+
 // GetID returns a unique ID that we derive from a bridge's three-tuple (i.e.,
 // its IP address, port, and protocol).  We derive the unique ID by doing a
-// HMAC (keyed with a master secret from our config file) over the bridge's
-// three-tuple.
-func (b *Bridge) GetID() string {
+// HMAC (keyed with the master secret from the given configuration) over the
+// bridge's three-tuple.
+func (b *Bridge) GetID(cfg *ConfigFile) string {
 
 	threeTuple := fmt.Sprintf("%s-%d-%s", b.Address.String(), b.Port, ProtoTypeTCP)
-	return Hmac([]byte(threeTuple))
+	return Hmac(cfg, []byte(threeTuple))
 }
 
-func (bs *Bridges) ReloadBridges(done chan bool) {
+// LoadReport tells us what we skipped while loading bridges from our sources.
+type LoadReport struct {
+	// SqliteFile is the BridgeDB database that we loaded, and Database
+	// tells us which of its bridges we left out.
+	SqliteFile string
+	Database   *DatabaseReport
+	// Files maps each of the descriptor files that we read to what we
+	// couldn't parse in it.
+	Files map[string]*ParseReport
+}
 
-	ticker := time.NewTicker(BridgeReloadInterval)
-	defer ticker.Stop()
+// logParseReport logs the given report of what we couldn't parse in the given
+// file: the malformed lines, and the bridges whose descriptors we skipped
+// lines of.  We log at most MaxLoggedParseErrors of each, so a thoroughly
+// broken file doesn't flood our log.
+func logParseReport(filename string, report *ParseReport) {
 
-	sentDone := false
-	for ; true; <-ticker.C {
-		db, err := sql.Open("sqlite3", config.SqliteFile)
-		if err != nil {
-			log.Printf("Failed to open SQLite database: %s", err)
-			continue
+	if len(report.Errors) == 0 {
+		return
+	}
+	log.Printf("Skipped %d malformed lines in %s.", len(report.Errors), filename)
+	for i, err := range report.Errors {
+		if i == MaxLoggedParseErrors {
+			log.Printf("... and %d more.", len(report.Errors)-i)
+			break
 		}
-		defer db.Close()
-		sql, err := LoadDatabase(db)
-		if err != nil {
-			log.Printf("Failed to read bridges from SQLite database: %s", err)
-			continue
+		log.Printf("%s: %s", filename, err)
+	}
+
+	// Bridges with the most skipped lines come first.
+	var fingerprints []string
+	for f := range report.Skipped {
+		fingerprints = append(fingerprints, f)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		fi, fj := fingerprints[i], fingerprints[j]
+		if report.Skipped[fi] != report.Skipped[fj] {
+			return report.Skipped[fi] > report.Skipped[fj]
+		}
+		return fi < fj
+	})
+	for i, f := range fingerprints {
+		if i == MaxLoggedParseErrors {
+			log.Printf("... and %d more descriptors.", len(fingerprints)-i)
+			break
+		}
+		if f == "" {
+			log.Printf("%s: skipped %d lines outside of any descriptor.", filename, report.Skipped[f])
+		} else {
+			log.Printf("%s: skipped %d lines of bridge %s's descriptor.", filename, report.Skipped[f], f)
+		}
+	}
+}
+
+// logDatabaseReport logs the malformed rows that we skipped when loading the
+// given BridgeDB database.  Like logParseReport, we log at most
+// MaxLoggedParseErrors of them.
+func logDatabaseReport(filename string, report *DatabaseReport) {
+
+	if len(report.Errors) == 0 {
+		return
+	}
+	log.Printf("Skipped %d malformed rows in %s.", len(report.Errors), filename)
+	for i, err := range report.Errors {
+		if i == MaxLoggedParseErrors {
+			log.Printf("... and %d more.", len(report.Errors)-i)
+			break
 		}
+		log.Printf("%s: %s", filename, err)
+	}
+}
 
-		file, err := os.Open(config.ExtrainfoFile)
-		if err != nil {
-			log.Printf("Failed to open extrainfo file: %s", err)
-			continue
+// applyNetworkstatus sets the flags and additional ORPorts of the given
+// bridges from the given bridge networkstatus document.  Bridges that the
+// document doesn't list get no flags, i.e., we consider them not running.
+func applyNetworkstatus(bs *Bridges, filename string) (*ParseReport, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open networkstatus file: %s", err)
+	}
+	defer file.Close()
+	statuses, report, err := ParseNetworkstatusDoc(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bridges from networkstatus file: %s", err)
+	}
+	logParseReport(filename, report)
+
+	notRunning := 0
+	for f, b := range bs.Bridges {
+		if status, ok := statuses.Bridges[f]; ok {
+			b.Flags = status.Flags
+			b.ORAddresses = status.ORAddresses
+		} else {
+			b.Flags = []string{}
+		}
+		if !b.IsRunning() {
+			notRunning++
 		}
-		defer file.Close()
-		extra, err := ParseExtrainfoDoc(file)
-		if err != nil {
-			log.Printf("Failed to read bridges from extrainfo file: %s", err)
+	}
+	log.Printf("Excluded %d bridges that the bridge authority doesn't consider running.", notRunning)
+	return report, nil
+}
+
+// applyServerDescriptors sets the requested distribution method of the given
+// bridges, and adds their additional ORPorts, from the given server
+// descriptors.
+func applyServerDescriptors(bs *Bridges, filename string) (*ParseReport, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open descriptors file: %s", err)
+	}
+	defer file.Close()
+	descs, report, err := ParseServerDescriptors(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bridges from descriptors file: %s", err)
+	}
+	logParseReport(filename, report)
+
+	optedOut := 0
+	for f, b := range bs.Bridges {
+		desc, ok := descs.Bridges[f]
+		if !ok {
 			continue
 		}
+		b.DistributionRequest = desc.DistributionRequest
+		for _, a := range desc.ORAddresses {
+			b.addORAddress(a)
+		}
+		if b.OptedOut() {
+			optedOut++
+		}
+	}
+	log.Printf("Excluded %d bridges whose operators opted out of distribution.", optedOut)
+	return report, nil
+}
 
-		for f, b1 := range sql.Bridges {
-			// Do we have any transports for this bridge?
-			if b2, ok := extra.Bridges[f]; ok {
-				b1.Transports = b2.Transports
-			}
+// loadBridges loads our bridges from BridgeDB's SQLite database, adds the
+// transports from the extra-info file and (if configured) the flags from the
+// networkstatus file and the distribution requests from the descriptors file,
+// and applies our usage statistics and probe results.  We also return what we
+// skipped in each of these sources.  If record is set, we
+// first record the bridges' current usage in our usage history; read-only
+// callers like -export-blocked don't, so they don't skew our history.
+// Cancelling the given context aborts the reload.
+func loadBridges(ctx context.Context, record bool) (*Bridges, *LoadReport, error) {
+
+	cfg := getConfig()
+	db, err := sql.Open("sqlite3", cfg.SqliteFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open SQLite database: %s", err)
+	}
+	defer db.Close()
+	sql, dbReport, err := LoadDatabase(ctx, db, cfg.GetFreshnessWindow())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read bridges from SQLite database: %s", err)
+	}
+	loadReport := &LoadReport{
+		SqliteFile: cfg.SqliteFile,
+		Database:   dbReport,
+		Files:      make(map[string]*ParseReport),
+	}
+	log.Printf("Excluded %d bridges that BridgeDB didn't see within the last %s.",
+		dbReport.Stale, cfg.GetFreshnessWindow())
+	logDatabaseReport(cfg.SqliteFile, dbReport)
+
+	file, err := os.Open(cfg.ExtrainfoFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open extrainfo file: %s", err)
+	}
+	defer file.Close()
+	extra, report, err := ParseExtrainfoDoc(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read bridges from extrainfo file: %s", err)
+	}
+	logParseReport(cfg.ExtrainfoFile, report)
+	loadReport.Files[cfg.ExtrainfoFile] = report
+
+	for f, b1 := range sql.Bridges {
+		// Do we have any transports for this bridge?
+		if b2, ok := extra.Bridges[f]; ok {
+			b1.Transports = b2.Transports
+			b1.Usage = b2.Usage
 		}
+	}
 
-		log.Printf("Successfully loaded %d bridges.", len(sql.Bridges))
-		bs.Update(sql)
+	if cfg.NetworkstatusFile != "" {
+		if report, err = applyNetworkstatus(sql, cfg.NetworkstatusFile); err != nil {
+			return nil, nil, err
+		}
+		loadReport.Files[cfg.NetworkstatusFile] = report
+	}
+
+	if cfg.DescriptorsFile != "" {
+		if report, err = applyServerDescriptors(sql, cfg.DescriptorsFile); err != nil {
+			return nil, nil, err
+		}
+		loadReport.Files[cfg.DescriptorsFile] = report
+	}
 
-		// Once, after our very first run, we signal to the caller that we're
-		// done.  The caller can the proceed to start the REST API.
-		if !sentDone {
-			done <- true
-			sentDone = true
+	// Parsing our files may take a while, so we check if we should give up
+	// before we modify our tables.
+	if err = ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if record {
+		if err = usage.Record(sql, cfg.GetUsagePolicy(), now); err != nil {
+			return nil, nil, fmt.Errorf("failed to record usage statistics: %s", err)
 		}
 	}
+	if err = usage.ApplyTo(sql, cfg.GetUsagePolicy(), now); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply usage statistics to bridges: %s", err)
+	}
+	suspected := 0
+	for _, b := range sql.Bridges {
+		if len(b.SuspectedBlockedIn) > 0 {
+			suspected++
+		}
+	}
+	log.Printf("Suspect %d bridges to be blocked somewhere because their usage dropped.", suspected)
+	if err = results.ApplyTo(cfg, sql); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply probe results to bridges: %s", err)
+	}
+
+	return sql, loadReport, nil
 }
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	keyApiTokens     = "api_tokens"
+	keyOrganisations = "organisations"
+)
+
+// subcommands maps the name of each of our subcommands to its function.  Each
+// function takes the subcommand's arguments and writes its output to the
+// given writer.
+var subcommands = map[string]func(args []string, out io.Writer) error{
+	"token":  tokenCommand,
+	"org":    orgCommand,
+	"config": configCommand,
+}
+
+// runSubcommand runs the subcommand that's named by the first of the given
+// arguments, e.g., "token add -config wolpertinger.json -organisation foo".
+func runSubcommand(args []string, out io.Writer) error {
+
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return cmd(args[1:], out)
+}
+
+// rawConfig represents our configuration file as a map of raw JSON values,
+// which allows us to edit some fields while preserving all others.
+type rawConfig map[string]json.RawMessage
+
+// readRawConfig reads the given configuration file.
+func readRawConfig(filename string) (rawConfig, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c rawConfig
+	if err = json.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get unmarshals the given key's value into v.  A missing key leaves v alone.
+func (c rawConfig) get(key string, v interface{}) error {
+
+	raw, ok := c[key]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// set marshals v and stores it as the given key's value.
+func (c rawConfig) set(key string, v interface{}) error {
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c[key] = raw
+	return nil
+}
+
+// write validates the configuration and, if it's valid, atomically replaces
+// the given configuration file with it.  A running wolpertinger instance
+// notices the change and reloads the file.
+func (c rawConfig) write(filename string) error {
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = parseConfig(content); err != nil {
+		return fmt.Errorf("refusing to write invalid config: %s", err)
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// newFlagSet returns a flag set for the given subcommand, with a "-config"
+// flag that's stored in the given string.
+func newFlagSet(name string, configFilename *string, out io.Writer) *flag.FlagSet {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(configFilename, "config", "", "Configuration file.")
+	return fs
+}
+
+// parseTime parses the given RFC 3339 timestamp.  An empty string results in
+// a nil time.
+func parseTime(s string) (*time.Time, error) {
+
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// tokenCommand implements the subcommands "token add", "token revoke", and
+// "token list".
+func tokenCommand(args []string, out io.Writer) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: token add|revoke|list -config FILE [options]")
+	}
+
+	var configFilename, organisation, id, notBefore, expires string
+	var index int
+	var admin bool
+	fs := newFlagSet("token "+args[0], &configFilename, out)
+	switch args[0] {
+	case "add":
+		fs.StringVar(&organisation, "organisation", "", "Organisation that the token belongs to.")
+		fs.StringVar(&notBefore, "not-before", "", "RFC 3339 timestamp before which the token is invalid.")
+		fs.StringVar(&expires, "expires", "", "RFC 3339 timestamp at which the token expires.")
+		fs.BoolVar(&admin, "admin", false, "Grant the token access to the admin API.")
+	case "revoke":
+		fs.StringVar(&id, "id", "", "ID of the token to revoke.")
+		fs.IntVar(&index, "index", -1, "Index of the token to revoke, for tokens without ID.")
+	case "list":
+	default:
+		return fmt.Errorf("unknown subcommand \"token %s\"", args[0])
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if configFilename == "" {
+		return errors.New("no configuration file given")
+	}
+
+	c, err := readRawConfig(configFilename)
+	if err != nil {
+		return err
+	}
+	// We keep each token as a map of raw values, so we preserve fields that
+	// we don't know about.
+	var rawTokens []map[string]json.RawMessage
+	if err = c.get(keyApiTokens, &rawTokens); err != nil {
+		return err
+	}
+	var tokens []ApiToken
+	if err = c.get(keyApiTokens, &tokens); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if organisation == "" {
+			return errors.New("no organisation given")
+		}
+		token, apiToken, err := NewApiToken(organisation)
+		if err != nil {
+			return err
+		}
+		if apiToken.NotBefore, err = parseTime(notBefore); err != nil {
+			return err
+		}
+		if apiToken.Expires, err = parseTime(expires); err != nil {
+			return err
+		}
+		apiToken.Admin = admin
+		// Our new token has no unknown fields, so we can marshal it as is.
+		var all []interface{}
+		for _, t := range rawTokens {
+			all = append(all, t)
+		}
+		if err = c.set(keyApiTokens, append(all, apiToken)); err != nil {
+			return err
+		}
+		if err = c.write(configFilename); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Added token %s for organisation %q.\n", apiToken.ID, organisation)
+		fmt.Fprintf(out, "Authentication token: %s\n", token)
+
+	case "revoke":
+		if (id == "") == (index < 0) {
+			return errors.New("need either -id or -index")
+		}
+		if id != "" {
+			index = -1
+			for i, t := range tokens {
+				if t.ID == id {
+					index = i
+				}
+			}
+			if index < 0 {
+				return fmt.Errorf("no token with ID %q", id)
+			}
+		}
+		if index >= len(tokens) {
+			return fmt.Errorf("no token with index %d", index)
+		}
+		// We don't remove revoked tokens, so the configuration file keeps a
+		// record of them.  A token that isn't valid yet mustn't become valid
+		// after expiring, so we drop its not_before timestamp.
+		now := time.Now().UTC().Truncate(time.Second)
+		rawNow, err := json.Marshal(now)
+		if err != nil {
+			return err
+		}
+		rawTokens[index]["expires"] = rawNow
+		if t := tokens[index]; t.NotBefore != nil && !t.NotBefore.Before(now) {
+			delete(rawTokens[index], "not_before")
+		}
+		if err = c.set(keyApiTokens, rawTokens); err != nil {
+			return err
+		}
+		if err = c.write(configFilename); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked token %d of organisation %q.\n", index, tokens[index].Organisation)
+
+	case "list":
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "INDEX\tID\tORGANISATION\tSTATUS\tNOT BEFORE\tEXPIRES\tADMIN")
+		now := time.Now()
+		for i, t := range tokens {
+			status := "active"
+			if !t.IsActive(now) {
+				status = "inactive"
+			}
+			if t.Token != "" {
+				status += " (plaintext)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%t\n", i, orDash(t.ID), t.Organisation,
+				status, formatTime(t.NotBefore), formatTime(t.Expires), t.Admin)
+		}
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// orDash returns the given string, or "-" if the string is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatTime returns the given time as RFC 3339 timestamp, or "-" if the time
+// is nil.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// orgCommand implements the subcommands "org add" and "org disable".
+func orgCommand(args []string, out io.Writer) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: org add|disable -config FILE -name NAME [options]")
+	}
+
+	var configFilename, name, strategy, pools string
+	fs := newFlagSet("org "+args[0], &configFilename, out)
+	fs.StringVar(&name, "name", "", "Name of the organisation.")
+	switch args[0] {
+	case "add":
+		fs.StringVar(&strategy, "strategy", "", "Bridge selection strategy.")
+		fs.StringVar(&pools, "pools", "", "Comma-separated list of BridgeDB distributors to hand out bridges from.")
+	case "disable":
+	default:
+		return fmt.Errorf("unknown subcommand \"org %s\"", args[0])
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if configFilename == "" {
+		return errors.New("no configuration file given")
+	}
+	if name == "" {
+		return errors.New("no organisation name given")
+	}
+
+	c, err := readRawConfig(configFilename)
+	if err != nil {
+		return err
+	}
+	// Again, we keep each organisation as a map of raw values, so we preserve
+	// fields that we don't know about.
+	orgs := make(map[string]map[string]json.RawMessage)
+	if err = c.get(keyOrganisations, &orgs); err != nil {
+		return err
+	}
+	if orgs == nil {
+		orgs = make(map[string]map[string]json.RawMessage)
+	}
+
+	switch args[0] {
+	case "add":
+		if _, ok := orgs[name]; ok {
+			return fmt.Errorf("organisation %q already exists", name)
+		}
+		org := make(map[string]json.RawMessage)
+		if strategy != "" {
+			org["strategy"], _ = json.Marshal(strategy)
+		}
+		if pools != "" {
+			org["pools"], _ = json.Marshal(strings.Split(pools, ","))
+		}
+		orgs[name] = org
+
+	case "disable":
+		org, ok := orgs[name]
+		if !ok || org == nil {
+			// Organisations don't need their own settings, so an
+			// organisation that only has tokens exists too.
+			var tokens []ApiToken
+			if err = c.get(keyApiTokens, &tokens); err != nil {
+				return err
+			}
+			if !hasTokens(tokens, name) {
+				return fmt.Errorf("no organisation %q", name)
+			}
+			org = make(map[string]json.RawMessage)
+			orgs[name] = org
+		}
+		org["disabled"] = json.RawMessage("true")
+	}
+
+	if err = c.set(keyOrganisations, orgs); err != nil {
+		return err
+	}
+	if err = c.write(configFilename); err != nil {
+		return err
+	}
+	if args[0] == "add" {
+		fmt.Fprintf(out, "Added organisation %q.  Use \"token add\" to give it a token.\n", name)
+	} else {
+		fmt.Fprintf(out, "Disabled organisation %q.\n", name)
+	}
+	return nil
+}
+
+// hasTokens returns 'true' if any of the given tokens belongs to the given
+// organisation.
+func hasTokens(tokens []ApiToken, organisation string) bool {
+
+	for _, t := range tokens {
+		if t.Organisation == organisation {
+			return true
+		}
+	}
+	return false
+}
+
+// configCommand implements the subcommand "config validate".
+func configCommand(args []string, out io.Writer) error {
+
+	if len(args) == 0 || args[0] != "validate" {
+		return errors.New("usage: config validate -config FILE")
+	}
+
+	var configFilename string
+	fs := newFlagSet("config validate", &configFilename, out)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if configFilename == "" {
+		return errors.New("no configuration file given")
+	}
+
+	if _, err := loadConfigFile(configFilename); err != nil {
+		return fmt.Errorf("%s is invalid: %s", configFilename, err)
+	}
+	fmt.Fprintf(out, "%s is valid.\n", configFilename)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSubcommands(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	content := `{"master_key": "foo",
+	             "api_tokens": [{"organisation": "foo", "token": "bar", "comment": "legacy"}],
+	             "sqlite_file": "bridges.sqlite",
+	             "extrainfo_file": "cached-extrainfo",
+	             "unknown_field": {"a": 1}}`
+	if err = ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %s", err)
+	}
+	run := func(args ...string) (string, error) {
+		out := new(bytes.Buffer)
+		err := runSubcommand(append(args, "-config", filename), out)
+		return out.String(), err
+	}
+
+	out, err := run("token", "add", "-organisation", "baz", "-not-before", "2029-01-01T00:00:00Z",
+		"-expires", "2030-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Failed to add token: %s", err)
+	}
+	token := regexp.MustCompile(`Authentication token: (\S+)`).FindStringSubmatch(out)
+	id := regexp.MustCompile(`Added token (\S+)`).FindStringSubmatch(out)
+	if token == nil || id == nil {
+		t.Fatalf("Unexpected output of 'token add': %q", out)
+	}
+
+	c, err := loadConfigFile(filename)
+	if err != nil {
+		t.Fatalf("Subcommand wrote invalid config: %s", err)
+	}
+	if len(c.ApiTokens) != 2 || !c.ApiTokens[1].Matches(token[1]) || c.ApiTokens[1].Expires == nil {
+		t.Error("Failed to add token to config.")
+	}
+	raw, _ := ioutil.ReadFile(filename)
+	if !strings.Contains(string(raw), "unknown_field") || !strings.Contains(string(raw), "legacy") {
+		t.Error("Failed to preserve unknown fields.")
+	}
+
+	if _, err = run("token", "revoke", "-id", id[1]); err != nil {
+		t.Fatalf("Failed to revoke token: %s", err)
+	}
+	if _, err = run("token", "revoke", "-index", "0"); err != nil {
+		t.Fatalf("Failed to revoke token: %s", err)
+	}
+	if _, err = run("token", "revoke", "-id", "foo"); err == nil {
+		t.Error("Revoked nonexistent token.")
+	}
+	// The token that isn't valid yet must remain a valid configuration entry.
+	if _, err = loadConfigFile(filename); err != nil {
+		t.Errorf("Revoking wrote invalid config: %s", err)
+	}
+	out, err = run("token", "list")
+	if err != nil {
+		t.Fatalf("Failed to list tokens: %s", err)
+	}
+	if strings.Count(out, "inactive") != 2 {
+		t.Errorf("Expected two inactive tokens in output:\n%s", out)
+	}
+
+	if out, err = run("org", "add", "-name", "baz", "-strategy", "foo"); err == nil {
+		t.Error("Added organisation with invalid strategy.")
+	} else if strings.Contains(out, "Added") {
+		t.Errorf("Reported success although we didn't write the config:\n%s", out)
+	}
+	if _, err = run("org", "add", "-name", "baz", "-strategy", "round-robin", "-pools", "moat,https"); err != nil {
+		t.Fatalf("Failed to add organisation: %s", err)
+	}
+	if _, err = run("org", "add", "-name", "baz"); err == nil {
+		t.Error("Added organisation twice.")
+	}
+	if _, err = run("org", "disable", "-name", "baz"); err != nil {
+		t.Fatalf("Failed to disable organisation: %s", err)
+	}
+	if _, err = run("org", "disable", "-name", "bza"); err == nil {
+		t.Error("Disabled nonexistent organisation.")
+	}
+	// Organisation "foo" only has a token, but no settings of its own.
+	if _, err = run("org", "disable", "-name", "foo"); err != nil {
+		t.Errorf("Failed to disable organisation without settings: %s", err)
+	}
+	c, _ = loadConfigFile(filename)
+	org := c.GetOrgConfig("baz")
+	if org.Strategy != StrategyRoundRobin || len(org.Pools) != 2 || !org.Disabled {
+		t.Error("Failed to add and disable organisation.")
+	}
+
+	if _, err = run("config", "validate"); err != nil {
+		t.Errorf("Failed to validate config: %s", err)
+	}
+	ioutil.WriteFile(filename, []byte(`{"master_key": ""}`), 0600)
+	if _, err = run("config", "validate"); err == nil {
+		t.Error("Failed to reject invalid config.")
+	}
+}
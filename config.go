@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultBridgesPerRequest = 1
+
+	// DefaultFreshnessWindow determines how long before the most recently
+	// seen bridge BridgeDB must have seen a bridge for us to load it.
+	DefaultFreshnessWindow = time.Hour
+
+	// ConfigPollInterval determines how often we check if our configuration
+	// file changed on disk.
+	ConfigPollInterval = 10 * time.Second
+)
+
+// currentConfig holds a *ConfigFile that represents our current
+// configuration.  Use getConfig and setConfig to access it.
+var currentConfig atomic.Value
+
+// ConfigFile represents our JSON-encoded configuration file.
+type ConfigFile struct {
+	MasterKey     string     `json:"master_key"`
+	ApiTokens     []ApiToken `json:"api_tokens"`
+	SqliteFile    string     `json:"sqlite_file"`
+	ExtrainfoFile string     `json:"extrainfo_file"`
+	// NetworkstatusFile is the bridge authority's networkstatus-bridges file.
+	// If empty, we don't know which bridges are running.
+	NetworkstatusFile string `json:"networkstatus_file"`
+	// DescriptorsFile is the bridge authority's cached-descriptors file.  If
+	// empty, we don't know which bridges' operators opted out of
+	// distribution.
+	DescriptorsFile string `json:"descriptors_file"`
+	// BridgesPerRequest determines how many bridges we return per request.
+	BridgesPerRequest int `json:"bridges_per_request"`
+	// Organisations maps an organisation (as used in ApiTokens) to its
+	// settings.  Organisations without an entry get our defaults.
+	Organisations map[string]*OrgConfig `json:"organisations"`
+	// Verdict determines when we consider a bridge blocked in a location.
+	Verdict VerdictPolicy `json:"verdict"`
+	// AuditLogFile is the file to which we log each bridge that we hand out,
+	// as JSON lines.  If empty, we don't keep an audit log.
+	AuditLogFile string `json:"audit_log_file"`
+	// MaxReloadAge determines how long ago our last successful reload of
+	// bridges may be before /readyz reports that we're not ready.
+	MaxReloadAge Duration `json:"max_reload_age"`
+	// FreshnessWindow determines how long before the most recently seen
+	// bridge BridgeDB must have seen a bridge for us to load it.
+	FreshnessWindow Duration `json:"freshness_window"`
+	// Usage determines when we suspect a bridge to be blocked in a country
+	// because its usage there dropped.
+	Usage UsagePolicy `json:"usage"`
+}
+
+// OrgConfig represents an organisation's settings.
+type OrgConfig struct {
+	// Strategy determines how we select bridges for the organisation's
+	// clients, e.g., "round-robin".
+	Strategy string `json:"strategy"`
+	// Pools contains the BridgeDB distributors (e.g., "unallocated" or
+	// "moat") whose bridges we hand out to the organisation's clients.
+	Pools []string `json:"pools"`
+	// Control is set if the organisation's clients run on uncensored vantage
+	// points, and may therefore submit control measurements.
+	Control bool `json:"control"`
+	// RateLimit is the number of requests per minute that the organisation's
+	// clients may make, all together.  Zero means no limit.
+	RateLimit int `json:"rate_limit"`
+	// ClientRateLimit is the number of requests per minute that each of the
+	// organisation's clients (as identified by its ID) may make.  Zero means
+	// no limit.
+	ClientRateLimit int `json:"client_rate_limit"`
+	// DailyQuota is the number of bridges per day that we hand out to the
+	// organisation's clients, all together.  Zero means no limit.
+	DailyQuota int `json:"daily_quota"`
+	// ClientDailyQuota is the number of bridges per day that we hand out to
+	// each of the organisation's clients.  Zero means no limit.
+	ClientDailyQuota int `json:"client_daily_quota"`
+	// AssignmentEpoch determines how long a client keeps getting the same
+	// bridges if the organisation uses the "stable-assignment" strategy.
+	AssignmentEpoch Duration `json:"assignment_epoch"`
+	// Disabled is set if the organisation's tokens are temporarily not
+	// accepted.
+	Disabled bool `json:"disabled"`
+	// PreferNew makes us hand out bridges that BridgeDB first saw within
+	// the given duration before all other bridges, so new bridges get
+	// tested early.  Zero disables this preference.
+	PreferNew Duration `json:"prefer_new"`
+	// SkipExpiring makes us skip bridges that BridgeDB hasn't seen for at
+	// least the given duration, relative to the most recently seen bridge.
+	// BridgeDB is about to expire these bridges.  Zero disables skipping.
+	SkipExpiring Duration `json:"skip_expiring"`
+}
+
+// GetOrgConfig returns the settings of the given organisation.  If we have no
+// settings for the organisation, we return our defaults.
+func (c *ConfigFile) GetOrgConfig(organisation string) *OrgConfig {
+
+	// We return a copy, so we can fill in our defaults without modifying
+	// the configuration.
+	org := &OrgConfig{}
+	if o, ok := c.Organisations[organisation]; ok && o != nil {
+		*org = *o
+	}
+	if org.Strategy == "" {
+		org.Strategy = DefaultStrategy
+	}
+	if len(org.Pools) == 0 {
+		org.Pools = DefaultPools
+	}
+	if org.AssignmentEpoch.Duration <= 0 {
+		org.AssignmentEpoch.Duration = DefaultAssignmentEpoch
+	}
+	return org
+}
+
+// GetMaxReloadAge returns the maximum age of our last successful reload of
+// bridges, or our default if the configuration doesn't set one.
+func (c *ConfigFile) GetMaxReloadAge() time.Duration {
+
+	if c.MaxReloadAge.Duration <= 0 {
+		return DefaultMaxReloadAge
+	}
+	return c.MaxReloadAge.Duration
+}
+
+// GetFreshnessWindow returns our freshness window, or our default if the
+// configuration doesn't set one.
+func (c *ConfigFile) GetFreshnessWindow() time.Duration {
+
+	if c.FreshnessWindow.Duration <= 0 {
+		return DefaultFreshnessWindow
+	}
+	return c.FreshnessWindow.Duration
+}
+
+// getConfig returns our current configuration.  The returned configuration
+// must not be modified; use setConfig to replace it instead.
+func getConfig() *ConfigFile {
+
+	if c, ok := currentConfig.Load().(*ConfigFile); ok {
+		return c
+	}
+	return &ConfigFile{}
+}
+
+// setConfig atomically replaces our current configuration with the given
+// configuration.  Requests that are in flight keep using the configuration
+// that they started with: each request calls getConfig once, and passes the
+// result along (e.g., to GetBridges, our distributors, and GetID).
+func setConfig(c *ConfigFile) {
+
+	currentConfig.Store(c)
+	resetDistributors()
+}
+
+// loadConfigFile loads and validates our JSON-encoded configuration file from
+// disk.
+func loadConfigFile(filename string) (*ConfigFile, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(content)
+}
+
+// parseConfig parses and validates the given JSON-encoded configuration.
+func parseConfig(content []byte) (*ConfigFile, error) {
+
+	c := &ConfigFile{}
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, err
+	}
+	if c.BridgesPerRequest <= 0 {
+		c.BridgesPerRequest = DefaultBridgesPerRequest
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	for i, t := range c.ApiTokens {
+		if t.Token != "" {
+			log.Printf("API token %d of organisation %q is stored in plaintext.  "+
+				"Consider replacing it with a salted hash; see 'token add'.", i, t.Organisation)
+		}
+	}
+
+	return c, nil
+}
+
+// Validate returns an error if the configuration is unusable.
+func (c *ConfigFile) Validate() error {
+
+	if c.MasterKey == "" {
+		return errors.New("no master key given")
+	}
+	if c.SqliteFile == "" {
+		return errors.New("no SQLite file given")
+	}
+	if c.ExtrainfoFile == "" {
+		return errors.New("no extrainfo file given")
+	}
+	for i, t := range c.ApiTokens {
+		if t.Organisation == "" {
+			return fmt.Errorf("API token %d has no organisation", i)
+		}
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("API token %d of organisation %q: %s", i, t.Organisation, err)
+		}
+	}
+
+	for name, org := range c.Organisations {
+		if org == nil {
+			continue
+		}
+		if _, err := NewDistributor(org.Strategy); err != nil {
+			return fmt.Errorf("organisation %q: %s", name, err)
+		}
+		for _, pool := range org.Pools {
+			switch pool {
+			case DistributorMoat, DistributorHttps, DistributorEmail, DistributorUnallocated:
+			default:
+				return fmt.Errorf("organisation %q: unknown pool %q", name, pool)
+			}
+		}
+	}
+
+	return nil
+}
+
+// reloadConfigFile loads the given configuration file and, if it's valid,
+// makes it our current configuration.  If it's invalid, we keep our current
+// configuration.
+func reloadConfigFile(filename string) {
+
+	c, err := loadConfigFile(filename)
+	if err != nil {
+		log.Printf("Failed to reload config file; keeping old configuration: %s", err)
+		return
+	}
+	if c.SqliteFile != getConfig().SqliteFile {
+		log.Printf("Changing the SQLite file only takes effect for bridges; " +
+			"our own tables remain in the old file until we restart.")
+	}
+	setConfig(c)
+	// Re-open our audit log, which may have been rotated.
+	auditLog.Close()
+	log.Printf("Reloaded config file %s.", filename)
+}
+
+// watchConfigFile reloads the given configuration file whenever we receive a
+// SIGHUP, or whenever the file's modification time changes, until the given
+// context is cancelled.
+func watchConfigFile(ctx context.Context, filename string) {
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var lastModified time.Time
+	if info, err := os.Stat(filename); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(ConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			log.Printf("Received SIGHUP; reloading config file.")
+		case <-ticker.C:
+			info, err := os.Stat(filename)
+			if err != nil || info.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			log.Printf("Config file changed on disk; reloading it.")
+		}
+		reloadConfigFile(filename)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfigFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	valid := `{"master_key": "foo",
+	           "api_tokens": [{"organisation": "foo", "token": "bar"}],
+	           "sqlite_file": "bridges.sqlite",
+	           "extrainfo_file": "cached-extrainfo"}`
+	if err = ioutil.WriteFile(filename, []byte(valid), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %s", err)
+	}
+	setConfig(&ConfigFile{})
+	reloadConfigFile(filename)
+	if getConfig().MasterKey != "foo" {
+		t.Fatal("Failed to load valid config file.")
+	}
+	if getConfig().BridgesPerRequest != DefaultBridgesPerRequest {
+		t.Error("Failed to set default number of bridges per request.")
+	}
+
+	invalid := []string{
+		`{"master_key": "bar"`,
+		`{"master_key": "", "sqlite_file": "foo", "extrainfo_file": "bar"}`,
+		`{"master_key": "bar", "sqlite_file": "foo", "extrainfo_file": "bar",
+		  "api_tokens": [{"organisation": "foo", "token": ""}]}`,
+		`{"master_key": "bar", "sqlite_file": "foo", "extrainfo_file": "bar",
+		  "organisations": {"foo": {"strategy": "foo"}}}`,
+		`{"master_key": "bar", "sqlite_file": "foo", "extrainfo_file": "bar",
+		  "organisations": {"foo": {"pools": ["foo"]}}}`,
+	}
+	for _, content := range invalid {
+		if err = ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write config file: %s", err)
+		}
+		reloadConfigFile(filename)
+		if getConfig().MasterKey != "foo" {
+			t.Errorf("Replaced config with invalid config %q.", content)
+		}
+	}
+}
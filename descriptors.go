@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	ServerDescriptorPrefix    = "router"
+	FingerprintPrefix         = "fingerprint"
+	PublishedPrefix           = "published"
+	ORAddressDescriptorPrefix = "or-address"
+	DistributionRequestPrefix = "bridge-distribution-request"
+
+	// DistributionRequestNone means that the bridge's operator doesn't want
+	// the bridge distributed at all, and DistributionRequestAny means that
+	// the operator doesn't mind how it's distributed.
+	DistributionRequestNone = "none"
+	DistributionRequestAny  = "any"
+
+	// PublishedLayout is the layout of the timestamp in 'published' lines.
+	PublishedLayout = "2006-01-02 15:04:05"
+	// RouterLineWords is the number of words in a 'router' line.
+	RouterLineWords = 6
+	// A 'fingerprint' line contains ten groups of four hex digits.
+	FingerprintGroups      = 10
+	FingerprintGroupLength = 4
+)
+
+// parseFingerprintLine parses the given line of the format:
+//
+//	"fingerprint" fingerprint NL
+//
+// ...in which the fingerprint consists of ten groups of four hex digits, and
+// returns the upper-case fingerprint without spaces.
+func parseFingerprintLine(words []string) (string, error) {
+
+	if len(words) != FingerprintGroups+1 {
+		return "", errors.New("incorrect number of words in 'fingerprint' line")
+	}
+	for _, group := range words[1:] {
+		if len(group) != FingerprintGroupLength {
+			return "", fmt.Errorf("malformed group %q in 'fingerprint' line", group)
+		}
+	}
+	fingerprint := strings.Join(words[1:], "")
+	if !isFingerprint(fingerprint) {
+		return "", fmt.Errorf("invalid fingerprint %q", fingerprint)
+	}
+	return strings.ToUpper(fingerprint), nil
+}
+
+// serverDescriptor represents a server descriptor while we parse it.
+type serverDescriptor struct {
+	bridge    *Bridge
+	line      int
+	published time.Time
+}
+
+// ParseServerDescriptors parses the given bridge server descriptors (i.e., a
+// bridge authority's cached-descriptors file), and returns their bridges with
+// their requested distribution method and additional ORPorts.  If a bridge
+// has several descriptors, we use the one that was published last.  We skip
+// malformed lines, and descriptors whose 'router' or 'fingerprint' line is
+// malformed, and report them in the returned ParseReport.  We only return an
+// error if we cannot read the document.
+func ParseServerDescriptors(r io.Reader) (*Bridges, *ParseReport, error) {
+
+	var bridges = NewBridges()
+	report := newParseReport()
+	published := make(map[string]time.Time)
+	var d *serverDescriptor
+	// skipping is set while we're inside a descriptor whose 'router' line is
+	// malformed.
+	skipping := false
+
+	// finish adds the descriptor that we're parsing to our bridges, unless
+	// we already have a more recent descriptor of the same bridge.
+	finish := func() {
+		if d == nil {
+			return
+		}
+		if d.bridge.Fingerprint == "" {
+			report.skip(d.line, "", errors.New("descriptor has no 'fingerprint' line"))
+		} else if last, ok := published[d.bridge.Fingerprint]; !ok || !d.published.Before(last) {
+			published[d.bridge.Fingerprint] = d.published
+			bridges.Bridges[d.bridge.Fingerprint] = d.bridge
+		}
+		d = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxDescriptorLineLength)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		if words[0] == ServerDescriptorPrefix {
+			finish()
+			skipping = false
+			if len(words) != RouterLineWords {
+				report.skip(lineNum, "", errors.New("incorrect number of words in 'router' line"))
+				skipping = true
+				continue
+			}
+			d = &serverDescriptor{bridge: NewBridge(), line: lineNum}
+			continue
+		}
+
+		switch words[0] {
+		case FingerprintPrefix, PublishedPrefix, ORAddressDescriptorPrefix, DistributionRequestPrefix:
+		default:
+			continue
+		}
+		if skipping {
+			report.Skipped[""]++
+			continue
+		}
+		if d == nil {
+			report.skip(lineNum, "", fmt.Errorf("'%s' line outside of descriptor", words[0]))
+			continue
+		}
+		b := d.bridge
+
+		switch words[0] {
+		case FingerprintPrefix:
+			fingerprint, err := parseFingerprintLine(words)
+			if err != nil {
+				// Without fingerprint, the descriptor is useless.
+				report.skip(lineNum, "", err)
+				d = nil
+				skipping = true
+				continue
+			}
+			b.Fingerprint = fingerprint
+
+		case PublishedPrefix:
+			t, err := time.Parse(PublishedLayout, strings.Join(words[1:], " "))
+			if err != nil {
+				report.skip(lineNum, b.Fingerprint, fmt.Errorf("invalid timestamp in 'published' line: %s", err))
+				continue
+			}
+			d.published = t
+
+		// We're dealing with one of the bridge's additional ORPorts.  There
+		// may be several.
+		case ORAddressDescriptorPrefix:
+			if len(words) != 2 {
+				report.skip(lineNum, b.Fingerprint, errors.New("incorrect number of words in 'or-address' line"))
+				continue
+			}
+			addr, port, err := parseAddrPort(words[1])
+			if err != nil {
+				report.skip(lineNum, b.Fingerprint, err)
+				continue
+			}
+			b.ORAddresses = append(b.ORAddresses, &ORAddress{Address: addr, Port: port})
+
+		case DistributionRequestPrefix:
+			if len(words) != 2 {
+				report.skip(lineNum, b.Fingerprint, errors.New("incorrect number of words in 'bridge-distribution-request' line"))
+				continue
+			}
+			b.DistributionRequest = strings.ToLower(words[1])
+		}
+	}
+	finish()
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("line %d: %s", lineNum+1, err)
+	}
+
+	return bridges, report, nil
+}
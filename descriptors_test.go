@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseServerDescriptors(t *testing.T) {
+
+	doc := `@purpose bridge
+router foo 1.2.3.4 443 0 0
+platform Tor 0.4.4.6 on Linux
+published 2020-12-01 10:00:00
+fingerprint A0EC 5B0F C51A 5CD8 00B9 D1D1 6D32 5636 B575 5BCE
+or-address [2001:db8::1]:443
+bridge-distribution-request None
+router-signature
+-----BEGIN SIGNATURE-----
+cm91dGVy
+-----END SIGNATURE-----
+@purpose bridge
+router foo 1.2.3.4 443 0 0
+published 2020-11-30 10:00:00
+fingerprint A0EC 5B0F C51A 5CD8 00B9 D1D1 6D32 5636 B575 5BCE
+bridge-distribution-request any
+router bar 1.2.3.5 9001 0 0
+published 2020-12-01 10:00:00
+fingerprint 5150 2DF3 D176 CC10 C52C C656 9420 5BBA 185E 0982
+or-address bridge.example.com:443
+bridge-distribution-request moat
+router baz 1.2.3.6 9001 0 0
+published 2020-12-01 10:00:00
+fingerprint 6150 2DF3 D176 CC10 C52C C656 9420 5BBA 185E
+or-address [2001:db8::2]:443
+router qux 1.2.3.7 9001 0 0
+published 2020-12-01 10:00:00
+`
+	bridges, report, err := ParseServerDescriptors(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Failed to parse server descriptors: %s", err)
+	}
+	if len(bridges.Bridges) != 2 {
+		t.Fatalf("Expected 2 bridges but got %d.", len(bridges.Bridges))
+	}
+
+	// We use the most recently published descriptor, regardless of order.
+	b := bridges.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	if b == nil || b.DistributionRequest != DistributionRequestNone || !b.OptedOut() {
+		t.Fatal("Failed to parse distribution request of most recent descriptor.")
+	}
+	if len(b.ORAddresses) != 1 || b.ORAddresses[0].Address.String() != "2001:db8::1" || b.ORAddresses[0].Port != 443 {
+		t.Errorf("Failed to parse 'or-address' line: %v", b.ORAddresses)
+	}
+
+	b = bridges.Bridges["51502DF3D176CC10C52CC65694205BBA185E0982"]
+	if b == nil || b.DistributionRequest != DistributorMoat || b.OptedOut() {
+		t.Error("Failed to parse distribution request.")
+	}
+
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if len(lines) != 3 || lines[0] != 20 || lines[1] != 24 || lines[2] != 26 {
+		t.Errorf("Expected errors in lines 20, 24, and 26 but got %v.", report.Errors)
+	}
+}
+
+func TestAddORAddress(t *testing.T) {
+
+	b := NewBridge()
+	for _, s := range []string{"[2001:db8::1]:443", "[2001:db8:0::1]:443", "[2001:db8::1]:9001"} {
+		addr, port, err := parseAddrPort(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.addORAddress(&ORAddress{Address: addr, Port: port})
+	}
+	if len(b.ORAddresses) != 2 {
+		t.Errorf("Expected 2 distinct additional ORPorts but got %d.", len(b.ORAddresses))
+	}
+}
+
+func FuzzParseServerDescriptors(f *testing.F) {
+
+	f.Add(`router foo 1.2.3.4 443 0 0
+published 2020-12-01 10:00:00
+fingerprint A0EC 5B0F C51A 5CD8 00B9 D1D1 6D32 5636 B575 5BCE
+or-address [2001:db8::1]:443
+bridge-distribution-request none
+`)
+	f.Add("fingerprint A0EC\nrouter foo\nor-address 1.2.3.4:443\n")
+	f.Fuzz(func(t *testing.T, doc string) {
+		bridges, _, err := ParseServerDescriptors(strings.NewReader(doc))
+		if err != nil {
+			return
+		}
+		for f, b := range bridges.Bridges {
+			if !isFingerprint(f) || f != b.Fingerprint {
+				t.Errorf("Invalid fingerprint %q.", f)
+			}
+		}
+	})
+}
@@ -1,19 +1,180 @@
 package main
 
-// GetBridges queries our backend to find and return bridges that we want
-// tested by censorship measurement platforms like OONI.
-func GetBridges(req *ClientRequest) (*Bridges, error) {
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	StrategyLeastRecentlyTested = "least-recently-tested"
+	StrategyRoundRobin          = "round-robin"
+	StrategyRandomByAge         = "random-weighted-by-age"
+	StrategyStableAssignment    = "stable-assignment"
+
+	DefaultStrategy = StrategyLeastRecentlyTested
+)
+
+// DefaultPools contains the BridgeDB distributors whose bridges we hand out to
+// organisations that don't configure their own pools.
+var DefaultPools = []string{DistributorUnallocated}
+
+// Distributor represents a strategy to select the bridges that we hand out to
+// a client.
+type Distributor interface {
+	// Select returns up to n of the given candidate bridges for the given
+	// client request, based on the given configuration.
+	Select(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int) []*Bridge
+}
+
+// distributors maps an organisation to its distributor.  We keep distributors
+// around across requests because some of them (e.g., round-robin) are
+// stateful.
+var distributors = struct {
+	sync.Mutex
+	m map[string]Distributor
+}{m: make(map[string]Distributor)}
+
+// NewDistributor returns a new distributor that implements the given
+// strategy.
+func NewDistributor(strategy string) (Distributor, error) {
+
+	switch strategy {
+	case StrategyLeastRecentlyTested, "":
+		return &LeastRecentlyTestedDistributor{}, nil
+	case StrategyRoundRobin:
+		return &RoundRobinDistributor{}, nil
+	case StrategyRandomByAge:
+		return &RandomByAgeDistributor{}, nil
+	case StrategyStableAssignment:
+		return &StableAssignmentDistributor{}, nil
+	}
+	return nil, fmt.Errorf("unknown selection strategy %q", strategy)
+}
+
+// getDistributor returns the given organisation's distributor, which we
+// create on first use.  We only keep distributors that we created based on
+// our current configuration, so a request that's still using an old
+// configuration cannot leave behind a distributor with an old strategy.
+func getDistributor(cfg *ConfigFile, organisation string) Distributor {
+
+	distributors.Lock()
+	defer distributors.Unlock()
+
+	if d, ok := distributors.m[organisation]; ok && cfg == getConfig() {
+		return d
+	}
+	d, err := NewDistributor(cfg.GetOrgConfig(organisation).Strategy)
+	if err != nil {
+		// We validate strategies when loading our config file, so this
+		// shouldn't happen.
+		d = &LeastRecentlyTestedDistributor{}
+	}
+	if cfg == getConfig() {
+		distributors.m[organisation] = d
+	}
+	return d
+}
+
+// resetDistributors discards all distributors, e.g., after we loaded a new
+// configuration file.
+func resetDistributors() {
+
+	distributors.Lock()
+	distributors.m = make(map[string]Distributor)
+	distributors.Unlock()
+}
+
+// inPools returns 'true' if the given bridge is in one of the given pools.
+func inPools(b *Bridge, pools []string) bool {
+	for _, pool := range pools {
+		if b.Distributor == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBridges queries our backend to find and return up to n bridges that we
+// want tested by censorship measurement platforms like OONI.  We only consider
+// bridges from the requesting organisation's pools, skip bridges whose ORPort
+// and transports we all know to be blocked in the client's country, and let
+// the organisation's distributor pick among the remaining bridges.  We never
+// hand out bridges that the bridge authority doesn't consider running, or
+// whose operators opted out of distribution.  If the organisation configured
+// it, we also skip bridges that are about to expire, and prefer new bridges.
+// We return copies of the selected bridges, so the caller may use them without
+// holding our bridges' lock.  The given configuration is the one that the
+// request started with.
+func GetBridges(cfg *ConfigFile, req *ClientRequest, n int) (*Bridges, error) {
 
 	bs := NewBridges()
+	org := cfg.GetOrgConfig(req.Organisation)
 
 	bridges.m.Lock()
+	defer bridges.m.Unlock()
+
+	var latest time.Time
+	for _, bridge := range bridges.Bridges {
+		if bridge.LastSeen.After(latest) {
+			latest = bridge.LastSeen
+		}
+	}
+
+	var candidates, newCandidates []*Bridge
 	for _, bridge := range bridges.Bridges {
-		if bridge.Distributor == DistributorUnallocated {
-			bs.Add(bridge)
-			break
+		if !inPools(bridge, org.Pools) {
+			continue
+		}
+		if len(bridge.TestableTransports(req.Location)) == 0 {
+			continue
+		}
+		if !bridge.IsRunning() || bridge.OptedOut() {
+			continue
+		}
+		if isExpiring(bridge, latest, org.SkipExpiring.Duration) {
+			continue
+		}
+		if isNew(bridge, latest, org.PreferNew.Duration) {
+			newCandidates = append(newCandidates, bridge)
+		} else {
+			candidates = append(candidates, bridge)
+		}
+	}
+
+	// We first select among new bridges, and fill up with other bridges if
+	// there aren't enough new ones.
+	d := getDistributor(cfg, req.Organisation)
+	for _, bridge := range d.Select(cfg, req, newCandidates, n) {
+		bs.Add(bridge.Copy())
+	}
+	if remaining := n - len(bs.Bridges); remaining > 0 {
+		for _, bridge := range d.Select(cfg, req, candidates, remaining) {
+			bs.Add(bridge.Copy())
 		}
 	}
-	bridges.m.Unlock()
 
 	return bs, nil
 }
+
+// isNew returns 'true' if BridgeDB first saw the given bridge within the given
+// duration before the given time, which is when BridgeDB last saw any bridge.
+// A zero duration means that no bridge is new.
+func isNew(b *Bridge, latest time.Time, d time.Duration) bool {
+
+	if d <= 0 || b.FirstSeen.IsZero() {
+		return false
+	}
+	return latest.Sub(b.FirstSeen) < d
+}
+
+// isExpiring returns 'true' if BridgeDB hasn't seen the given bridge for at
+// least the given duration before the given time, which is when BridgeDB last
+// saw any bridge.  A zero duration means that no bridge is expiring.
+func isExpiring(b *Bridge, latest time.Time, d time.Duration) bool {
+
+	if d <= 0 || b.LastSeen.IsZero() {
+		return false
+	}
+	return latest.Sub(b.LastSeen) >= d
+}
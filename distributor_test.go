@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestBridges returns a set of unallocated bridges with the given
+// fingerprints.
+func newTestBridges(fingerprints ...string) *Bridges {
+
+	bs := NewBridges()
+	for _, f := range fingerprints {
+		b := NewBridge()
+		b.Fingerprint = f
+		b.Distributor = DistributorUnallocated
+		bs.Add(b)
+	}
+	return bs
+}
+
+func TestGetBridges(t *testing.T) {
+
+	setConfig(&ConfigFile{})
+	bs := newTestBridges("blocked", "tested", "untested", "allocated")
+	bs.Bridges["blocked"].BlockedIn = []*Location{&Location{"ru", 1234}}
+	bs.Bridges["tested"].LastTested["ru"] = time.Now()
+	bs.Bridges["allocated"].Distributor = DistributorMoat
+	bridges.Update(bs)
+
+	ret, err := GetBridges(getConfig(), &ClientRequest{Location: "ru"}, 2)
+	if err != nil {
+		t.Fatalf("Failed to get bridges: %s", err)
+	}
+	if len(ret.Bridges) != 2 {
+		t.Fatalf("Expected 2 bridges but got %d.", len(ret.Bridges))
+	}
+	if _, ok := ret.Bridges["blocked"]; ok {
+		t.Error("Handed out bridge that's blocked in the client's country.")
+	}
+	if _, ok := ret.Bridges["allocated"]; ok {
+		t.Error("Handed out bridge that's allocated to another distributor.")
+	}
+
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ru"}, 1)
+	if _, ok := ret.Bridges["untested"]; !ok {
+		t.Error("Failed to prefer untested bridge.")
+	}
+
+	// We hand out copies, which new verdicts don't modify.
+	if b, ok := ret.Bridges["untested"]; ok {
+		bs.Bridges["untested"].BlockedIn = []*Location{&Location{Country: "ru"}}
+		if b.IsBlockedIn("ru") {
+			t.Error("Handed out live bridge instead of a copy.")
+		}
+		bs.Bridges["untested"].BlockedIn = nil
+	}
+
+	// The bridge that's blocked in Russia is fine to hand out in Iran.
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ir"}, 3)
+	if len(ret.Bridges) != 3 {
+		t.Errorf("Expected 3 bridges but got %d.", len(ret.Bridges))
+	}
+
+	// We don't hand out bridges that aren't running.
+	bs.Bridges["tested"].Flags = []string{FlagValid}
+	bs.Bridges["untested"].Flags = []string{FlagRunning, FlagValid}
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ir"}, 3)
+	if _, ok := ret.Bridges["tested"]; ok || len(ret.Bridges) != 2 {
+		t.Error("Handed out bridge that isn't running.")
+	}
+
+	// Nor do we hand out bridges whose operators opted out.
+	bs.Bridges["untested"].DistributionRequest = DistributionRequestNone
+	bs.Bridges["blocked"].DistributionRequest = DistributorMoat
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ir"}, 3)
+	if _, ok := ret.Bridges["untested"]; ok || len(ret.Bridges) != 1 {
+		t.Error("Handed out bridge whose operator opted out of distribution.")
+	}
+}
+
+func TestGetBridgesBySeen(t *testing.T) {
+
+	setConfig(&ConfigFile{Organisations: map[string]*OrgConfig{
+		"foo": &OrgConfig{
+			PreferNew:    Duration{24 * time.Hour},
+			SkipExpiring: Duration{3 * time.Hour},
+		},
+	}})
+	latest := time.Date(2020, 12, 1, 12, 0, 0, 0, time.UTC)
+	bs := newTestBridges("new", "old", "expiring")
+	for _, b := range bs.Bridges {
+		b.FirstSeen = latest.Add(-30 * 24 * time.Hour)
+		b.LastSeen = latest
+	}
+	bs.Bridges["new"].FirstSeen = latest.Add(-time.Hour)
+	bs.Bridges["expiring"].LastSeen = latest.Add(-4 * time.Hour)
+	bridges.Update(bs)
+
+	req := &ClientRequest{Organisation: "foo", Location: "ru"}
+	ret, _ := GetBridges(getConfig(), req, 1)
+	if _, ok := ret.Bridges["new"]; !ok {
+		t.Error("Failed to prefer new bridge.")
+	}
+	ret, _ = GetBridges(getConfig(), req, 3)
+	if len(ret.Bridges) != 2 {
+		t.Errorf("Expected 2 bridges but got %d.", len(ret.Bridges))
+	}
+	if _, ok := ret.Bridges["expiring"]; ok {
+		t.Error("Handed out bridge that's about to expire.")
+	}
+
+	// Organisations without these settings get all bridges.
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ru"}, 3)
+	if len(ret.Bridges) != 3 {
+		t.Errorf("Expected 3 bridges but got %d.", len(ret.Bridges))
+	}
+}
+
+func TestGetDistributorWithOldConfig(t *testing.T) {
+
+	old := &ConfigFile{Organisations: map[string]*OrgConfig{
+		"foo": &OrgConfig{Strategy: StrategyRoundRobin},
+	}}
+	setConfig(&ConfigFile{})
+
+	// A request that started before we loaded our current configuration
+	// gets a distributor based on its own configuration...
+	if _, ok := getDistributor(old, "foo").(*RoundRobinDistributor); !ok {
+		t.Error("Ignored the request's configuration.")
+	}
+	// ...which we don't keep around for later requests.
+	if _, ok := getDistributor(getConfig(), "foo").(*LeastRecentlyTestedDistributor); !ok {
+		t.Error("Kept distributor that's based on an old configuration.")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	ExportFormatJSON     = "json"
+	ExportFormatBridgeDB = "bridgedb"
+)
+
+// BlockedBridge represents a bridge's vanilla ORPort or one of its transports,
+// and the locations in which it's blocked.
+type BlockedBridge struct {
+	Fingerprint string      `json:"fingerprint"`
+	Transport   string      `json:"transport"`
+	BlockedIn   []*Location `json:"blocked_in"`
+}
+
+// GetBlockedBridges returns all bridges (and transports) in the given set that
+// are blocked in at least one location, sorted by fingerprint.  A bridge's
+// vanilla ORPort comes before its transports, which are sorted by type.
+func GetBlockedBridges(bs *Bridges) []*BlockedBridge {
+
+	bs.m.Lock()
+	defer bs.m.Unlock()
+
+	var blocked []*BlockedBridge
+	for _, b := range bs.Bridges {
+		if len(b.BlockedIn) > 0 {
+			blocked = append(blocked, &BlockedBridge{b.Fingerprint, BridgeTypeVanilla, b.BlockedIn})
+		}
+		for _, t := range b.Transports {
+			if len(t.BlockedIn) > 0 {
+				blocked = append(blocked, &BlockedBridge{b.Fingerprint, t.Type, t.BlockedIn})
+			}
+		}
+	}
+
+	sort.Slice(blocked, func(i, j int) bool {
+		if blocked[i].Fingerprint != blocked[j].Fingerprint {
+			return blocked[i].Fingerprint < blocked[j].Fingerprint
+		}
+		if blocked[i].Transport == BridgeTypeVanilla || blocked[j].Transport == BridgeTypeVanilla {
+			return blocked[i].Transport == BridgeTypeVanilla
+		}
+		return blocked[i].Transport < blocked[j].Transport
+	})
+
+	return blocked
+}
+
+// WriteBlockedBridges writes the given blocked bridges to the given writer in
+// the given format, which is either ExportFormatJSON or ExportFormatBridgeDB.
+func WriteBlockedBridges(w io.Writer, blocked []*BlockedBridge, format string) error {
+
+	switch format {
+	case ExportFormatJSON:
+		return writeBlockedJSON(w, blocked)
+	case ExportFormatBridgeDB:
+		return writeBlockedBridgeDB(w, blocked)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// writeBlockedJSON writes the given blocked bridges as a JSON array.
+func writeBlockedJSON(w io.Writer, blocked []*BlockedBridge) error {
+
+	if blocked == nil {
+		// Marshal an empty array rather than 'null'.
+		blocked = []*BlockedBridge{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(blocked)
+}
+
+// writeBlockedBridgeDB writes the given blocked bridges in BridgeDB's
+// blocked-bridges format, i.e., one line per bridge and country:
+//
+//	fingerprint FINGERPRINT [transport TYPE] country_code CC NL
+//
+// The transport is omitted for a bridge's vanilla ORPort.  BridgeDB only
+// understands countries, so we skip locations that consist of nothing but an
+// AS number.
+func writeBlockedBridgeDB(w io.Writer, blocked []*BlockedBridge) error {
+
+	for _, b := range blocked {
+		transport := ""
+		if b.Transport != BridgeTypeVanilla {
+			transport = fmt.Sprintf(" transport %s", b.Transport)
+		}
+
+		seen := make(map[string]bool)
+		for _, l := range b.BlockedIn {
+			if l.Country == "" || seen[l.Country] {
+				continue
+			}
+			seen[l.Country] = true
+			_, err := fmt.Fprintf(w, "fingerprint %s%s country_code %s\n", b.Fingerprint, transport, l.Country)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
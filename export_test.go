@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteBlockedBridges(t *testing.T) {
+
+	bs := newTestBridges("B", "A")
+	bs.Bridges["A"].BlockedIn = []*Location{&Location{"ru", 1234}, &Location{"ru", 0}, &Location{"", 4321}}
+	tr := NewTransport()
+	tr.Type = BridgeTypeObfs4
+	tr.BlockedIn = []*Location{&Location{"cn", 0}}
+	bs.Bridges["A"].AddTransport(tr)
+
+	blocked := GetBlockedBridges(bs)
+	if len(blocked) != 2 {
+		t.Fatalf("Expected 2 blocked bridges but got %d.", len(blocked))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteBlockedBridges(buf, blocked, ExportFormatBridgeDB); err != nil {
+		t.Fatalf("Failed to write blocked bridges: %s", err)
+	}
+	expected := "fingerprint A country_code ru\nfingerprint A transport obfs4 country_code cn\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%q\nbut got\n%q", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteBlockedBridges(buf, blocked, ExportFormatJSON); err != nil {
+		t.Fatalf("Failed to write blocked bridges: %s", err)
+	}
+	var decoded []*BlockedBridge
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal JSON export: %s", err)
+	}
+	if len(decoded) != 2 || len(decoded[0].BlockedIn) != 3 || decoded[0].BlockedIn[2].ASN != 4321 {
+		t.Error("JSON export doesn't match blocked bridges.")
+	}
+
+	buf.Reset()
+	WriteBlockedBridges(buf, nil, ExportFormatJSON)
+	if buf.String() != "[]\n" {
+		t.Errorf("Expected empty JSON array but got %q.", buf.String())
+	}
+
+	if err := WriteBlockedBridges(buf, blocked, "foo"); err == nil {
+		t.Error("Failed to reject unknown export format.")
+	}
+}
@@ -6,55 +6,140 @@ import (
 	"fmt"
 	"io"
 	"net"
-	//"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	MinTransportWords = 3
-	TransportPrefix   = "transport"
-	ExtraInfoPrefix   = "extra-info"
+	MinTransportWords    = 3
+	TransportPrefix      = "transport"
+	ExtraInfoPrefix      = "extra-info"
+	BridgeStatsEndPrefix = "bridge-stats-end"
+	BridgeIPsPrefix      = "bridge-ips"
+
+	// StatsEndLayout is the layout of the timestamp in 'bridge-stats-end'
+	// lines.
+	StatsEndLayout = "2006-01-02 15:04:05"
+
+	// FingerprintLength is the length of a hex-encoded relay fingerprint.
+	FingerprintLength = 40
+	// MaxDescriptorLineLength is the maximum length of a line in a descriptor
+	// that we're willing to parse.
+	MaxDescriptorLineLength = 1 << 20
 )
 
+// ParseError represents a problem with a line in a descriptor document, e.g.,
+// an extra-info document.
+type ParseError struct {
+	Line int
+	// Fingerprint is the fingerprint of the bridge whose descriptor contains
+	// the line, if we know it.
+	Fingerprint string
+	Err         error
+}
+
+// Error returns a string representation of the parse error.
+func (e *ParseError) Error() string {
+
+	if e.Fingerprint == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d (bridge %s): %s", e.Line, e.Fingerprint, e.Err)
+}
+
+// ParseReport tells us what we couldn't parse in a descriptor document.  We
+// skip malformed lines (and descriptors whose first line is malformed)
+// instead of giving up on the entire document.
+type ParseReport struct {
+	Errors []*ParseError
+	// Skipped maps a bridge's fingerprint to the number of lines in its
+	// descriptor that we skipped.  The empty fingerprint counts lines that
+	// belong to no descriptor, or to a descriptor whose first line is
+	// malformed.
+	Skipped map[string]int
+}
+
+// newParseReport allocates and returns a new ParseReport object.
+func newParseReport() *ParseReport {
+	return &ParseReport{Skipped: make(map[string]int)}
+}
+
+// skip records that we skipped the given line of the given bridge's
+// descriptor because of the given error.
+func (r *ParseReport) skip(line int, fingerprint string, err error) {
+
+	r.Errors = append(r.Errors, &ParseError{Line: line, Fingerprint: fingerprint, Err: err})
+	r.Skipped[fingerprint]++
+}
+
+// isFingerprint returns 'true' if the given string is a hex-encoded relay
+// fingerprint.
+func isFingerprint(s string) bool {
+
+	if len(s) != FingerprintLength {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAddrPort parses the given address:port pair, whose address must be an
+// IP literal.  IPv6 addresses must be in square brackets, e.g., "[::1]:443".
+// Unlike net.ResolveIPAddr, we never resolve host names.
+func parseAddrPort(s string) (IPAddr, uint16, error) {
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return IPAddr{}, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return IPAddr{}, 0, fmt.Errorf("%q is not an IP address", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return IPAddr{}, 0, fmt.Errorf("invalid port %q", port)
+	}
+	return IPAddr{net.IPAddr{IP: ip}}, uint16(p), nil
+}
+
 // populateTransportInfo parses the given transport line of the format:
-//   "transport" transportname address:port [arglist] NL
+//
+//	"transport" transportname address:port [arglist] NL
+//
 // ...and writes it to the given transport object.  See the specification for
 // more details on what transport lines look like:
 // <https://gitweb.torproject.org/torspec.git/tree/dir-spec.txt?id=2b31c63891a63cc2cad0f0710a45989071b84114#n1234>
 func populateTransportInfo(transport string, t *Transport) error {
 
-	if !strings.HasPrefix(transport, TransportPrefix) {
+	words := strings.Fields(transport)
+	if len(words) == 0 || words[0] != TransportPrefix {
 		return errors.New("no 'transport' prefix")
 	}
-
-	words := strings.Split(transport, " ")
 	if len(words) < MinTransportWords {
 		return errors.New("not enough arguments in 'transport' line")
 	}
 	t.Type = words[1]
 
-	host, port, err := net.SplitHostPort(words[2])
+	addr, port, err := parseAddrPort(words[2])
 	if err != nil {
 		return err
 	}
-	addr, err := net.ResolveIPAddr("", host)
-	if err != nil {
-		return err
-	}
-	t.Address = IPAddr{net.IPAddr{addr.IP, addr.Zone}}
-	p, err := strconv.Atoi(port)
-	if err != nil {
-		return err
-	}
-	t.Port = uint16(p)
+	t.Address = addr
+	t.Port = port
 
-	// We may be dealing with one or more key=value pairs.
+	// We may be dealing with one or more key=value pairs.  Values may
+	// contain '=' characters.
 	if len(words) > MinTransportWords {
 		args := strings.Split(words[3], ",")
 		for _, arg := range args {
-			kv := strings.Split(arg, "=")
-			if len(kv) != 2 {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
 				return fmt.Errorf("key:value pair in %q not separated by a '='", words[3])
 			}
 			t.Parameters[kv[0]] = []string{kv[1]}
@@ -64,44 +149,166 @@ func populateTransportInfo(transport string, t *Transport) error {
 	return nil
 }
 
+// parseBridgeStatsEnd parses the given line of the format:
+//
+//	"bridge-stats-end" YYYY-MM-DD HH:MM:SS (NSEC s) NL
+//
+// ...and writes the end and length of the interval to the given usage
+// statistics.
+func parseBridgeStatsEnd(words []string, u *BridgeUsage) error {
+
+	if len(words) != 5 {
+		return errors.New("incorrect number of words in 'bridge-stats-end' line")
+	}
+	end, err := time.Parse(StatsEndLayout, words[1]+" "+words[2])
+	if err != nil {
+		return fmt.Errorf("invalid timestamp in 'bridge-stats-end' line: %s", err)
+	}
+	if !strings.HasPrefix(words[3], "(") || words[4] != "s)" {
+		return errors.New("malformed interval in 'bridge-stats-end' line")
+	}
+	secs, err := strconv.ParseUint(strings.TrimPrefix(words[3], "("), 10, 32)
+	if err != nil || secs == 0 {
+		return fmt.Errorf("invalid interval %q in 'bridge-stats-end' line", words[3])
+	}
+	u.StatsEnd = end
+	u.Interval = Duration{time.Duration(secs) * time.Second}
+	return nil
+}
+
+// parseBridgeIPs parses the given line of the format:
+//
+//	"bridge-ips" [CC=NUM,CC=NUM,...] NL
+//
+// ...and writes the number of clients per country to the given usage
+// statistics.  We store country codes in lower case.
+func parseBridgeIPs(words []string, u *BridgeUsage) error {
+
+	clients := make(map[string]int)
+	if len(words) > 2 {
+		return errors.New("too many words in 'bridge-ips' line")
+	}
+	if len(words) == 2 {
+		for _, pair := range strings.Split(words[1], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("malformed country:count pair %q in 'bridge-ips' line", pair)
+			}
+			n, err := strconv.ParseUint(kv[1], 10, 31)
+			if err != nil {
+				return fmt.Errorf("invalid count in %q in 'bridge-ips' line", pair)
+			}
+			clients[strings.ToLower(kv[0])] = int(n)
+		}
+	}
+	u.Clients = clients
+	return nil
+}
+
 // ParseExtrainfoDoc parses the given extra-info document and returns the
-// content as a Bridges object.  Note that the extra-info document format is as
-// it's produced by the bridge authority.
-func ParseExtrainfoDoc(r io.Reader) (*Bridges, error) {
+// content (i.e., bridges' transports and usage statistics) as a Bridges
+// object.  Note that the extra-info document format is as
+// it's produced by the bridge authority.  We skip malformed lines and
+// descriptors, and report them in the returned ParseReport.  We only
+// return an error if we cannot read the document.
+func ParseExtrainfoDoc(r io.Reader) (*Bridges, *ParseReport, error) {
 
 	var bridges = NewBridges()
 	var b *Bridge
+	report := newParseReport()
+	// stats holds the (possibly incomplete) usage statistics of the bridges
+	// that we parsed.
+	stats := make(map[*Bridge]*BridgeUsage)
+	// skipping is set while we're inside a descriptor whose 'extra-info' line
+	// is malformed.
+	skipping := false
 
 	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxDescriptorLineLength)
+	lineNum := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
+		lineNum++
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
 		// We're dealing with a new extra-info block, i.e., a new bridge.
-		if strings.HasPrefix(line, ExtraInfoPrefix) {
-			b = NewBridge()
-			words := strings.Split(line, " ")
+		case ExtraInfoPrefix:
+			b = nil
+			skipping = false
 			if len(words) != 3 {
-				return nil, errors.New("incorrect number of words in 'extra-info' line")
+				report.skip(lineNum, "", errors.New("incorrect number of words in 'extra-info' line"))
+				skipping = true
+				continue
+			}
+			if !isFingerprint(words[2]) {
+				report.skip(lineNum, "", fmt.Errorf("invalid fingerprint %q in 'extra-info' line", words[2]))
+				skipping = true
+				continue
 			}
-			b.Fingerprint = words[2]
+			b = NewBridge()
+			b.Fingerprint = strings.ToUpper(words[2])
 			bridges.Bridges[b.Fingerprint] = b
-		}
+
 		// We're dealing with a bridge's transport protocols.  There may be
 		// several.
-		if strings.HasPrefix(line, TransportPrefix) {
+		case TransportPrefix:
+			if skipping {
+				report.Skipped[""]++
+				continue
+			}
+			if b == nil {
+				report.skip(lineNum, "", errors.New("'transport' line outside of descriptor"))
+				continue
+			}
 			t := NewTransport()
 			t.Fingerprint = b.Fingerprint
-			err := populateTransportInfo(line, t)
-			if err != nil {
-				return nil, err
+			if err := populateTransportInfo(scanner.Text(), t); err != nil {
+				report.skip(lineNum, b.Fingerprint, err)
+				continue
 			}
 			b.AddTransport(t)
+
+		// We're dealing with a bridge's usage statistics, which are spread
+		// over two lines.
+		case BridgeStatsEndPrefix, BridgeIPsPrefix:
+			if skipping {
+				report.Skipped[""]++
+				continue
+			}
+			if b == nil {
+				report.skip(lineNum, "", fmt.Errorf("'%s' line outside of descriptor", words[0]))
+				continue
+			}
+			if stats[b] == nil {
+				stats[b] = &BridgeUsage{}
+			}
+			var err error
+			if words[0] == BridgeStatsEndPrefix {
+				err = parseBridgeStatsEnd(words, stats[b])
+			} else {
+				err = parseBridgeIPs(words, stats[b])
+			}
+			if err != nil {
+				report.skip(lineNum, b.Fingerprint, err)
+			}
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("line %d: %s", lineNum+1, err)
+	}
+
+	// We only keep usage statistics that are complete, i.e., that tell us
+	// both the clients and the interval in which they connected.  Bridges
+	// that appear several times get the statistics of their last descriptor.
+	for b, u := range stats {
+		if bridges.Bridges[b.Fingerprint] == b && !u.StatsEnd.IsZero() && u.Clients != nil {
+			b.Usage = u
+		}
 	}
 
-	return bridges, nil
+	return bridges, report, nil
 }
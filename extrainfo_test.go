@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPopulateTransportInfo(t *testing.T) {
@@ -28,7 +33,31 @@ func TestPopulateTransportInfo(t *testing.T) {
 		t.Errorf("Failed to parse transport port.")
 	}
 
-	if err = populateTransportInfo("transport bar 1.2.3.4:1234 a=b,foo=bar", transport); err != nil {
+	if err = populateTransportInfo("transport foo example.com:1234", transport); err == nil {
+		t.Errorf("Failed to reject host name.")
+	}
+
+	if err = populateTransportInfo("transport foo [2001:db8::1]:1234", transport); err != nil {
+		t.Errorf("Failed to parse transport line with IPv6 address: %s", err)
+	}
+	if transport.Address.String() != "2001:db8::1" {
+		t.Errorf("Failed to parse IPv6 address.")
+	}
+
+	for _, line := range []string{
+		"transport foo 2001:db8::1:1234",
+		"transport foo 1.2.3.4:0",
+		"transport foo 1.2.3.4:65536",
+		"transport foo 1.2.3.4",
+		"transport foo 1.2.3.4:1234 =b",
+		"transportfoo 1.2.3.4:1234",
+	} {
+		if err = populateTransportInfo(line, NewTransport()); err == nil {
+			t.Errorf("Failed to reject invalid transport line %q.", line)
+		}
+	}
+
+	if err = populateTransportInfo("transport bar 1.2.3.4:1234 a=b,foo=bar,cert=c=d", transport); err != nil {
 		t.Errorf("Failed to parse transport line.")
 	}
 	value, _ := transport.Parameters["a"]
@@ -39,11 +68,16 @@ func TestPopulateTransportInfo(t *testing.T) {
 	if value[0] != "bar" {
 		t.Errorf("Failed to parse transport arguments.")
 	}
+	value, _ = transport.Parameters["cert"]
+	if value[0] != "c=d" {
+		t.Errorf("Failed to parse transport argument that contains '='.")
+	}
 }
 
 func TestParseExtrainfoDoc(t *testing.T) {
 
 	var bridges *Bridges
+	var report *ParseReport
 	var err error
 	buf := bytes.NewBufferString(`extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE
 this line doesn't matter
@@ -53,9 +87,12 @@ transport obfs4 1.2.3.4:1234 key=value,1=2
 transport obfs5 1.2.3.4:4321 foo=bar
 `)
 
-	bridges, err = ParseExtrainfoDoc(buf)
+	bridges, report, err = ParseExtrainfoDoc(buf)
 	if err != nil {
-		t.Errorf("Failed to parse mock extra-info descriptors.")
+		t.Fatalf("Failed to parse mock extra-info descriptors.")
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("Unexpected parse errors: %v", report.Errors)
 	}
 
 	if len(bridges.Bridges) != 2 {
@@ -86,3 +123,179 @@ transport obfs5 1.2.3.4:4321 foo=bar
 		t.Errorf("Couldn't parse second obfs4 key=value pair.")
 	}
 }
+
+func TestParseMalformedExtrainfoDoc(t *testing.T) {
+
+	buf := bytes.NewBufferString(`transport obfs4 1.2.3.4:1234
+extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE
+transport obfs4 1.2.3.4:1234 key=value
+transport obfs4 bridge.example.com:1234
+transport meek [2001:db8::1]:443
+extra-info bar 51502DF3D176CC10C52CC65694205BBA
+transport obfs4 1.2.3.5:1234
+transport obfs4 1.2.3.5:4321
+extra-info-digest 0123456789ABCDEF0123456789ABCDEF01234567
+extra-info baz 61502DF3D176CC10C52CC65694205BBA185E0982
+transport obfs4 1.2.3.6:1234
+`)
+
+	bridges, report, err := ParseExtrainfoDoc(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse malformed extra-info descriptors: %s", err)
+	}
+	if len(bridges.Bridges) != 2 {
+		t.Errorf("Expected 2 bridges but got %d.", len(bridges.Bridges))
+	}
+	b, ok := bridges.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	if !ok || len(b.Transports) != 2 {
+		t.Fatal("Failed to keep the valid transports of a descriptor with a malformed transport.")
+	}
+	if b.Transports[1].Address.String() != "2001:db8::1" {
+		t.Error("Failed to parse transport with IPv6 address.")
+	}
+	if b, ok := bridges.Bridges["61502DF3D176CC10C52CC65694205BBA185E0982"]; !ok || len(b.Transports) != 1 {
+		t.Error("Failed to parse descriptor after malformed descriptor.")
+	}
+
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{1, 4, 6}) {
+		t.Errorf("Expected errors in lines [1 4 6] but got %v.", lines)
+	}
+	if report.Errors[1].Fingerprint != "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE" {
+		t.Errorf("Error lacks fingerprint of bridge: %s", report.Errors[1])
+	}
+	// The line before the first descriptor, and the malformed descriptor's
+	// 'extra-info' and two 'transport' lines.
+	if report.Skipped[""] != 4 {
+		t.Errorf("Expected 4 skipped lines outside valid descriptors but got %d.", report.Skipped[""])
+	}
+	if report.Skipped["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"] != 1 {
+		t.Errorf("Expected 1 skipped line in descriptor but got %d.",
+			report.Skipped["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"])
+	}
+
+	// We log the per-descriptor counts along with the errors.
+	logged := new(bytes.Buffer)
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+	logParseReport("cached-extrainfo", report)
+	for _, line := range []string{
+		"skipped 4 lines outside of any descriptor",
+		"skipped 1 lines of bridge A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE's descriptor",
+	} {
+		if !strings.Contains(logged.String(), line) {
+			t.Errorf("Log lacks %q:\n%s", line, logged)
+		}
+	}
+}
+
+func TestParseBridgeStats(t *testing.T) {
+
+	buf := bytes.NewBufferString(`extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE
+bridge-stats-end 2020-12-01 12:00:00 (86400 s)
+bridge-ips IR=16,de=8,??=8
+extra-info bar 51502DF3D176CC10C52CC65694205BBA185E0982
+bridge-stats-end 2020-12-01 12:00:00 (86400 s)
+bridge-ips
+extra-info baz 61502DF3D176CC10C52CC65694205BBA185E0982
+bridge-ips ir=16
+extra-info qux 71502DF3D176CC10C52CC65694205BBA185E0982
+bridge-stats-end 2020-12-01 12:00 (86400 s)
+bridge-ips ir=16,de
+`)
+
+	bridges, report, err := ParseExtrainfoDoc(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse extra-info descriptors: %s", err)
+	}
+
+	u := bridges.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"].Usage
+	if u == nil {
+		t.Fatal("Failed to parse usage statistics.")
+	}
+	if !u.StatsEnd.Equal(time.Date(2020, 12, 1, 12, 0, 0, 0, time.UTC)) || u.Interval.Duration != 24*time.Hour {
+		t.Errorf("Failed to parse 'bridge-stats-end' line: %+v", u)
+	}
+	if !reflect.DeepEqual(u.Clients, map[string]int{"ir": 16, "de": 8, "??": 8}) {
+		t.Errorf("Failed to parse 'bridge-ips' line: %v", u.Clients)
+	}
+
+	// A bridge without clients has empty statistics.
+	u = bridges.Bridges["51502DF3D176CC10C52CC65694205BBA185E0982"].Usage
+	if u == nil || len(u.Clients) != 0 {
+		t.Errorf("Failed to parse empty 'bridge-ips' line: %+v", u)
+	}
+
+	// We discard incomplete or malformed statistics.
+	for _, f := range []string{"61502DF3D176CC10C52CC65694205BBA185E0982", "71502DF3D176CC10C52CC65694205BBA185E0982"} {
+		if bridges.Bridges[f].Usage != nil {
+			t.Errorf("Kept incomplete usage statistics of bridge %s.", f)
+		}
+	}
+	if len(report.Errors) != 2 || report.Skipped["71502DF3D176CC10C52CC65694205BBA185E0982"] != 2 {
+		t.Errorf("Expected 2 errors in one descriptor but got %v.", report.Errors)
+	}
+}
+
+func FuzzPopulateTransportInfo(f *testing.F) {
+
+	for _, seed := range []string{
+		"transport obfs4 1.2.3.4:1234 cert=foo,iat-mode=0",
+		"transport meek [2001:db8::1]:443 url=https://example.com/",
+		"transport foo 1.2.3.4",
+		"transport",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		tr := NewTransport()
+		if err := populateTransportInfo(line, tr); err != nil {
+			return
+		}
+		if tr.Address.IP == nil || tr.Port == 0 {
+			t.Errorf("Accepted transport line %q without address or port.", line)
+		}
+	})
+}
+
+func FuzzParseExtrainfoDoc(f *testing.F) {
+
+	f.Add(`extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE
+transport obfs4 1.2.3.4:1234 key=value,1=2
+transport meek [2001:db8::1]:443
+`)
+	f.Add("transport obfs4 1.2.3.4:1234\nextra-info foo\n")
+	f.Add(`extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE
+bridge-stats-end 2020-12-01 12:00:00 (86400 s)
+bridge-ips ir=16,de=8
+`)
+	f.Fuzz(func(t *testing.T, doc string) {
+		bridges, report, err := ParseExtrainfoDoc(strings.NewReader(doc))
+		if err != nil {
+			return
+		}
+		skipped := 0
+		for _, n := range report.Skipped {
+			skipped += n
+		}
+		if skipped < len(report.Errors) {
+			t.Errorf("Reported %d errors but only %d skipped lines.", len(report.Errors), skipped)
+		}
+		for f, b := range bridges.Bridges {
+			if !isFingerprint(f) || f != b.Fingerprint {
+				t.Errorf("Invalid fingerprint %q.", f)
+			}
+			for _, tr := range b.Transports {
+				if tr.Fingerprint != f {
+					t.Errorf("Transport has fingerprint %q instead of %q.", tr.Fingerprint, f)
+				}
+			}
+			if b.Usage != nil && (b.Usage.StatsEnd.IsZero() || b.Usage.Clients == nil) {
+				t.Errorf("Kept incomplete usage statistics %+v.", b.Usage)
+			}
+		}
+	})
+}
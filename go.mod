@@ -1,5 +1,5 @@
 module gitlab.torproject.org/torproject/anti-censorship/wolpertinger
 
-go 1.14
+go 1.18
 
 require github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -20,21 +23,48 @@ type ClientRequest struct {
 	ProbeType string `json:"type"`
 	Location  string `json:"country_code"`
 	AuthToken string `json:"auth_token"`
+	// Organisation is the organisation that the client's authentication token
+	// belongs to, and TokenID is the token's ID.  We fill them in once we
+	// authenticated the request.
+	Organisation string `json:"-"`
+	TokenID      string `json:"-"`
 }
 
-// ServerResponse is the response to a ClientRequest.  It maps a bridge's ID to
-// a Bridge struct.
-type ServerResponse map[string]*Bridge
+// ServerResponse is the response to a ClientRequest.  It maps a bridge's (or
+// transport's) ID to a Transport struct.  A bridge's vanilla ORPort is
+// represented by a transport of type "vanilla".
+type ServerResponse map[string]*Transport
 
-// isRequestAuthenticated returns 'true' if we have the authentication token in
-// the client request on record.
-func isRequestAuthenticated(req *ClientRequest) bool {
-	for _, t := range config.ApiTokens {
-		if req.AuthToken == t.Token {
-			return true
+// isRequestAuthenticated returns 'true' if the given configuration has the
+// authentication token in the client request on record.  If so, we set the
+// request's organisation.
+func isRequestAuthenticated(cfg *ConfigFile, req *ClientRequest) bool {
+	t, ok := getApiToken(cfg, req.AuthToken)
+	if ok {
+		req.Organisation = t.Organisation
+		req.TokenID = t.ID
+	}
+	return ok
+}
+
+// getApiToken returns the given configuration's record of the given
+// authentication token, and 'true' if the configuration has the token on
+// record, it's currently active, and its organisation isn't disabled.  We
+// compare the given token to all of our tokens, so the time we take doesn't
+// depend on which token matched.
+func getApiToken(cfg *ConfigFile, token string) (*ApiToken, bool) {
+
+	now := time.Now()
+	var found *ApiToken
+	for i, t := range cfg.ApiTokens {
+		if t.Matches(token) && t.IsActive(now) && found == nil {
+			found = &cfg.ApiTokens[i]
 		}
 	}
-	return false
+	if found == nil || cfg.GetOrgConfig(found.Organisation).Disabled {
+		return nil, false
+	}
+	return found, true
 }
 
 // IndexHandler handles requests for the service's index page.  We respond with
@@ -45,20 +75,30 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Beware the Wolpertinger.")
 }
 
-// extractClientRequest attempts to extract a ClientRequest object from the
-// given HTTP request.
-func extractClientRequest(r *http.Request) (*ClientRequest, error) {
+// extractAuthToken attempts to extract the bearer token from the given HTTP
+// request's 'Authorization' header.
+func extractAuthToken(r *http.Request) (string, error) {
 
-	// Get our bearer token, which is in an HTTP Header.
 	tokenLine := r.Header.Get("Authorization")
 	if tokenLine == "" {
-		return nil, errors.New("request has not 'Authorization' HTTP header")
+		return "", errors.New("request has not 'Authorization' HTTP header")
 	}
 	if !strings.HasPrefix(tokenLine, "Bearer ") {
-		return nil, errors.New("authorization header contains no bearer token")
+		return "", errors.New("authorization header contains no bearer token")
 	}
 	fields := strings.Split(tokenLine, " ")
-	authToken := fields[1]
+	return fields[1], nil
+}
+
+// extractClientRequest attempts to extract a ClientRequest object from the
+// given HTTP request.
+func extractClientRequest(r *http.Request) (*ClientRequest, error) {
+
+	// Get our bearer token, which is in an HTTP Header.
+	authToken, err := extractAuthToken(r)
+	if err != nil {
+		return nil, err
+	}
 
 	// Now get our request fields, which are in the GET request URL.
 	if err := r.ParseForm(); err != nil {
@@ -84,7 +124,12 @@ func extractClientRequest(r *http.Request) (*ClientRequest, error) {
 		return nil, errors.New("need exactly one 'country_code' key")
 	}
 
-	return &ClientRequest{id[0], reqType[0], countryCode[0], authToken}, nil
+	return &ClientRequest{
+		Id:        id[0],
+		ProbeType: reqType[0],
+		Location:  strings.ToLower(countryCode[0]),
+		AuthToken: authToken,
+	}, nil
 }
 
 // BridgesHandler deals with clients (e.g., an OONI probe) requesting a bridge
@@ -97,22 +142,64 @@ func BridgesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !isRequestAuthenticated(req) {
+	// We use the same configuration throughout the request, even if it
+	// changes while we're busy.
+	cfg := getConfig()
+	if !isRequestAuthenticated(cfg, req) {
 		log.Printf("Received request with invalid authentication token.")
 		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
 		return
 	}
+	setOrganisation(w, req.Organisation)
 
-	bridges, err := GetBridges(req)
+	org := cfg.GetOrgConfig(req.Organisation)
+	now := time.Now()
+	n, wait, err := limiter.Allow(req, org, cfg.BridgesPerRequest, now)
+	if err != nil {
+		log.Printf("Error checking rate limits: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "rate limit or quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	bridges, err := GetBridges(cfg, req, n)
 	if err != nil {
 		log.Printf("Error getting bridges: %s", err)
+		if releaseErr := limiter.Release(req, org, n, now); releaseErr != nil {
+			log.Printf("Error updating quotas: %s", releaseErr)
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err = limiter.Release(req, org, n-len(bridges.Bridges), now); err != nil {
+		log.Printf("Error updating quotas: %s", err)
+	}
 
 	resp := ServerResponse{}
+	var entries []*AuditEntry
 	for _, bridge := range bridges.Bridges {
-		resp[bridge.GetID()] = bridge
+		for _, t := range bridge.TestableTransports(req.Location) {
+			id := t.GetID(cfg)
+			resp[id] = t
+			entries = append(entries, &AuditEntry{
+				Time:         now.UTC(),
+				Organisation: req.Organisation,
+				TokenID:      req.TokenID,
+				ClientID:     req.Id,
+				ProbeType:    req.ProbeType,
+				Country:      req.Location,
+				Fingerprint:  t.Fingerprint,
+				Transport:    t.Type,
+				BridgeID:     id,
+			})
+		}
+	}
+	if err = auditLog.Log(entries); err != nil {
+		log.Printf("Error writing audit log: %s", err)
 	}
 
 	json, err := json.Marshal(resp)
@@ -123,3 +210,85 @@ func BridgesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 	fmt.Fprintln(w, string(json))
 }
+
+// ResultsHandler deals with clients (e.g., an OONI probe) submitting the result
+// of probing a bridge.
+func ResultsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "results must be submitted via POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authToken, err := extractAuthToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg := getConfig()
+	token, ok := getApiToken(cfg, authToken)
+	if !ok {
+		log.Printf("Received result with invalid authentication token.")
+		http.Error(w, "invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+	org := token.Organisation
+	setOrganisation(w, org)
+
+	result, err := extractResult(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result.Organisation = org
+	result.TokenID = token.ID
+
+	if result.Control && !cfg.GetOrgConfig(org).Control {
+		log.Printf("Organisation %q may not submit control measurements.", org)
+		http.Error(w, "organisation may not submit control measurements", http.StatusForbidden)
+		return
+	}
+
+	if err = results.Add(cfg, result, &bridges); err != nil {
+		if err == errUnknownBridge {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("Error adding result: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metrics.ResultReceived(result)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BlockedHandler deals with clients (e.g., BridgeDB) asking for the bridges
+// that we consider blocked.  The list reveals bridges, so only admin tokens may
+// ask for it.  The optional GET parameter 'format' determines the output
+// format, which is either "json" (the default) or "bridgedb".
+func BlockedHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !isAdminRequest(getConfig(), w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportFormatJSON
+	}
+	if format != ExportFormatJSON && format != ExportFormatBridgeDB {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	if format == ExportFormatJSON {
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	} else {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err := WriteBlockedBridges(w, GetBlockedBridges(&bridges), format); err != nil {
+		log.Printf("Error writing blocked bridges: %s", err)
+	}
+}
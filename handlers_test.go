@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -29,12 +32,12 @@ func TestExtractClientRequest(t *testing.T) {
 	}
 
 	var apiToken = "KEWDlzJ7JLCBZ2dJ6pXa4P04aq0rbi1weJXGBAP0H/o="
-	config = ConfigFile{
-		"bogus master key",
-		[]ApiToken{ApiToken{"foo", apiToken}},
-		"bogus sqlite file",
-		"bogus extrainfo file",
-	}
+	setConfig(&ConfigFile{
+		MasterKey:     "bogus master key",
+		ApiTokens:     []ApiToken{ApiToken{Organisation: "foo", Token: apiToken}},
+		SqliteFile:    "bogus sqlite file",
+		ExtrainfoFile: "bogus extrainfo file",
+	})
 
 	req, _ = http.NewRequest("GET", fmt.Sprintf("%s?id=1234&type=foo&country_code=ru", baseUrl), nil)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
@@ -62,3 +65,68 @@ func TestExtractClientRequest(t *testing.T) {
 		t.Errorf("failed to accept empty id argument: %s", err.Error())
 	}
 }
+
+func TestBridgesHandler(t *testing.T) {
+
+	var apiToken = "KEWDlzJ7JLCBZ2dJ6pXa4P04aq0rbi1weJXGBAP0H/o="
+	setConfig(&ConfigFile{
+		MasterKey:         "bogus master key",
+		ApiTokens:         []ApiToken{ApiToken{Organisation: "foo", Token: apiToken}},
+		BridgesPerRequest: 1,
+	})
+	db := openTestDB(t)
+	defer db.Close()
+	limiter = NewLimiter(db)
+
+	bs := newTestBridges("A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE")
+	b := bs.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	b.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	b.Port = 443
+	obfs4 := NewTransport()
+	obfs4.Type = BridgeTypeObfs4
+	obfs4.Address = b.Address
+	obfs4.Port = 1234
+	obfs4.Fingerprint = b.Fingerprint
+	obfs4.Parameters["iat-mode"] = []string{"0"}
+	b.AddTransport(obfs4)
+	blocked := NewTransport()
+	blocked.Type = "meek"
+	blocked.Address = b.Address
+	blocked.Port = 4321
+	blocked.BlockedIn = []*Location{&Location{"ru", 0}}
+	b.AddTransport(blocked)
+	bridges.Update(bs)
+
+	req := httptest.NewRequest("GET", "/bridges?id=1234&type=foo&country_code=ru", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+	w := httptest.NewRecorder()
+	BridgesHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d but got %d", http.StatusOK, w.Code)
+	}
+
+	var resp map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 entries in response but got %d", len(resp))
+	}
+	vanilla, ok := resp[b.GetID(getConfig())]
+	if !ok || vanilla["type"] != BridgeTypeVanilla {
+		t.Error("response lacks the bridge's vanilla ORPort")
+	}
+	if _, ok := vanilla["params"]; ok {
+		t.Error("vanilla entry must not have parameters")
+	}
+	entry, ok := resp[obfs4.GetID(getConfig())]
+	if !ok || entry["type"] != BridgeTypeObfs4 || entry["protocol"] != ProtoTypeTCP {
+		t.Fatal("response lacks the bridge's obfs4 transport")
+	}
+	if _, ok := entry["params"]; !ok {
+		t.Error("obfs4 entry lacks parameters")
+	}
+	if _, ok := resp[blocked.GetID(getConfig())]; ok {
+		t.Error("response contains transport that's blocked in the client's country")
+	}
+}
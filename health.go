@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultMaxReloadAge determines how long ago our last successful reload
+	// of bridges may be before we consider ourselves not ready.
+	DefaultMaxReloadAge = 3 * BridgeReloadInterval
+)
+
+// Readiness represents the response of our readiness endpoint.
+type Readiness struct {
+	Ready      bool       `json:"ready"`
+	Reasons    []string   `json:"reasons,omitempty"`
+	Bridges    int        `json:"bridges"`
+	LastReload *time.Time `json:"last_reload,omitempty"`
+}
+
+// checkSource returns an error if we cannot open the given file for reading.
+func checkSource(name, filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %s", name, err)
+	}
+	return f.Close()
+}
+
+// GetReadiness determines if we're ready to serve requests, i.e., if we have
+// recently loaded a non-empty set of bridges, and if we can still read our
+// bridges' sources.
+func GetReadiness(bs *Bridges, lastReload, now time.Time) *Readiness {
+
+	cfg := getConfig()
+	r := &Readiness{}
+
+	bs.m.Lock()
+	r.Bridges = len(bs.Bridges)
+	bs.m.Unlock()
+	if r.Bridges == 0 {
+		r.Reasons = append(r.Reasons, "no bridges loaded")
+	}
+
+	if lastReload.IsZero() {
+		r.Reasons = append(r.Reasons, "bridges were never loaded successfully")
+	} else {
+		r.LastReload = &lastReload
+		if age := now.Sub(lastReload); age > cfg.GetMaxReloadAge() {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("last successful reload was %s ago", age.Round(time.Second)))
+		}
+	}
+
+	if err := checkSource("SQLite file", cfg.SqliteFile); err != nil {
+		r.Reasons = append(r.Reasons, err.Error())
+	}
+	if err := checkSource("extrainfo file", cfg.ExtrainfoFile); err != nil {
+		r.Reasons = append(r.Reasons, err.Error())
+	}
+	if cfg.NetworkstatusFile != "" {
+		if err := checkSource("networkstatus file", cfg.NetworkstatusFile); err != nil {
+			r.Reasons = append(r.Reasons, err.Error())
+		}
+	}
+	if cfg.DescriptorsFile != "" {
+		if err := checkSource("descriptors file", cfg.DescriptorsFile); err != nil {
+			r.Reasons = append(r.Reasons, err.Error())
+		}
+	}
+
+	r.Ready = len(r.Reasons) == 0
+	return r
+}
+
+// HealthzHandler tells monitoring tools that wolpertinger is alive.  We
+// respond as long as we're able to serve HTTP requests at all.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, `{"alive":true}`)
+}
+
+// ReadyzHandler tells monitoring tools (and load balancers) if wolpertinger is
+// ready to serve requests.  If not, we respond with HTTP status code 503 and
+// explain why.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	readiness := GetReadiness(&bridges, metrics.LastReloadSuccess(), time.Now())
+	json, err := json.Marshal(readiness)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, string(json))
+}
+
+// requireLoaded wraps the given handler, and responds with HTTP status code 503
+// until the given channel is closed, i.e., until we loaded bridges for the
+// first time.  This allows us to serve our health endpoints while we're still
+// busy loading bridges.
+func requireLoaded(loaded <-chan struct{}, h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-loaded:
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "bridges haven't been loaded yet", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetReadiness(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqliteFile := filepath.Join(dir, "bridges.sqlite")
+	extrainfoFile := filepath.Join(dir, "cached-extrainfo")
+	for _, f := range []string{sqliteFile, extrainfoFile} {
+		if err := ioutil.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setConfig(&ConfigFile{
+		SqliteFile:    sqliteFile,
+		ExtrainfoFile: extrainfoFile,
+		MaxReloadAge:  Duration{time.Hour},
+	})
+
+	now := time.Now()
+	bs := newTestBridges("A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE")
+	r := GetReadiness(bs, now.Add(-time.Minute), now)
+	if !r.Ready || len(r.Reasons) != 0 || r.Bridges != 1 {
+		t.Errorf("expected to be ready but got %+v", r)
+	}
+
+	// We have neither bridges nor a successful reload.
+	r = GetReadiness(NewBridges(), time.Time{}, now)
+	if r.Ready || len(r.Reasons) != 2 {
+		t.Errorf("expected two reasons for not being ready but got %+v", r)
+	}
+
+	// Our last successful reload is too old.
+	r = GetReadiness(bs, now.Add(-2*time.Hour), now)
+	if r.Ready || len(r.Reasons) != 1 || !strings.Contains(r.Reasons[0], "last successful reload") {
+		t.Errorf("expected stale reload to make us not ready but got %+v", r)
+	}
+
+	// We can no longer open our extrainfo file.
+	os.Remove(extrainfoFile)
+	r = GetReadiness(bs, now, now)
+	if r.Ready || len(r.Reasons) != 1 || !strings.Contains(r.Reasons[0], "extrainfo file") {
+		t.Errorf("expected missing extrainfo file to make us not ready but got %+v", r)
+	}
+}
+
+func TestRequireLoaded(t *testing.T) {
+
+	loaded := make(chan struct{})
+	h := requireLoaded(loaded, http.HandlerFunc(HealthzHandler))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridges", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d before loading bridges but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	close(loaded)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridges", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d after loading bridges but got %d", http.StatusOK, rec.Code)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets contains the upper bounds (in seconds) of our latency
+// histograms' buckets.  These are Prometheus's default buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics holds the metrics that we export via our /metrics endpoint.
+var metrics = NewMetrics()
+
+// requestKey identifies a counter of HTTP requests.
+type requestKey struct {
+	handler      string
+	organisation string
+	code         int
+}
+
+// resultKey identifies a counter of results that clients submitted.
+type resultKey struct {
+	outcome string
+	control bool
+}
+
+// histogram represents a Prometheus histogram.  Its buckets aren't cumulative;
+// we sum them up when writing the histogram.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// observe adds the given value to the histogram.
+func (h *histogram) observe(v float64) {
+
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics keeps track of wolpertinger's operation, and writes its metrics in
+// Prometheus's text-based exposition format.  We don't depend on Prometheus's
+// client library because we only need a handful of counters.
+type Metrics struct {
+	m                 sync.Mutex
+	reloadSuccesses   uint64
+	reloadFailures    uint64
+	lastReloadSuccess time.Time
+	requests          map[requestKey]uint64
+	latencies         map[string]*histogram
+	results           map[resultKey]uint64
+}
+
+// NewMetrics allocates and returns a new Metrics object.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[string]*histogram),
+		results:   make(map[resultKey]uint64),
+	}
+}
+
+// ReloadSucceeded records a successful reload of our bridges.
+func (m *Metrics) ReloadSucceeded(now time.Time) {
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.reloadSuccesses++
+	m.lastReloadSuccess = now
+}
+
+// ReloadFailed records a failed reload of our bridges.
+func (m *Metrics) ReloadFailed() {
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.reloadFailures++
+}
+
+// LastReloadSuccess returns the time of our last successful reload of our
+// bridges.  The time is zero if no reload succeeded yet.
+func (m *Metrics) LastReloadSuccess() time.Time {
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.lastReloadSuccess
+}
+
+// RequestServed records a request that the given handler served.
+func (m *Metrics) RequestServed(handler, organisation string, code int, latency time.Duration) {
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.requests[requestKey{handler, organisation, code}]++
+	h, ok := m.latencies[handler]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latencies[handler] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// ResultReceived records a result that a client submitted.
+func (m *Metrics) ResultReceived(r *Result) {
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.results[resultKey{r.Outcome(), r.Control}]++
+}
+
+// escapeLabel escapes the given label value as required by Prometheus's text
+// format.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatFloat formats the given value as required by Prometheus's text format.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeHeader writes the HELP and TYPE lines of the given metric.
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// countBridges returns the number of bridges (and transports) in the given
+// set of bridges, keyed by distributor and transport type.  The caller must
+// hold the bridges' lock.
+func countBridges(bs *Bridges) map[[2]string]int {
+
+	counts := make(map[[2]string]int)
+	for _, b := range bs.Bridges {
+		counts[[2]string{b.Distributor, BridgeTypeVanilla}]++
+		for _, t := range b.Transports {
+			counts[[2]string{b.Distributor, t.Type}]++
+		}
+	}
+	return counts
+}
+
+// WriteTo writes our metrics, and the number of bridges in the given set of
+// bridges, in Prometheus's text-based exposition format.
+func (m *Metrics) WriteTo(w io.Writer, bs *Bridges) {
+
+	bs.m.Lock()
+	counts := countBridges(bs)
+	bs.m.Unlock()
+
+	keys := make([][2]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	writeHeader(w, "wolpertinger_bridges", "Number of loaded bridges, by distributor and transport type.", "gauge")
+	for _, k := range keys {
+		fmt.Fprintf(w, "wolpertinger_bridges{distributor=\"%s\",transport=\"%s\"} %d\n",
+			escapeLabel(k[0]), escapeLabel(k[1]), counts[k])
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	writeHeader(w, "wolpertinger_reloads_total", "Number of attempts to reload bridges, by outcome.", "counter")
+	fmt.Fprintf(w, "wolpertinger_reloads_total{outcome=\"success\"} %d\n", m.reloadSuccesses)
+	fmt.Fprintf(w, "wolpertinger_reloads_total{outcome=\"failure\"} %d\n", m.reloadFailures)
+
+	writeHeader(w, "wolpertinger_last_reload_success_timestamp_seconds", "Time of the last successful reload of bridges.", "gauge")
+	var last float64
+	if !m.lastReloadSuccess.IsZero() {
+		last = float64(m.lastReloadSuccess.UnixNano()) / 1e9
+	}
+	fmt.Fprintf(w, "wolpertinger_last_reload_success_timestamp_seconds %s\n", formatFloat(last))
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.handler != b.handler {
+			return a.handler < b.handler
+		}
+		if a.organisation != b.organisation {
+			return a.organisation < b.organisation
+		}
+		return a.code < b.code
+	})
+	writeHeader(w, "wolpertinger_http_requests_total", "Number of HTTP requests, by handler, organisation, and status code.", "counter")
+	for _, k := range requests {
+		fmt.Fprintf(w, "wolpertinger_http_requests_total{handler=\"%s\",organisation=\"%s\",code=\"%d\"} %d\n",
+			escapeLabel(k.handler), escapeLabel(k.organisation), k.code, m.requests[k])
+	}
+
+	handlers := make([]string, 0, len(m.latencies))
+	for handler := range m.latencies {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	writeHeader(w, "wolpertinger_http_request_duration_seconds", "Time it took to serve HTTP requests, by handler.", "histogram")
+	for _, handler := range handlers {
+		h := m.latencies[handler]
+		label := escapeLabel(handler)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "wolpertinger_http_request_duration_seconds_bucket{handler=\"%s\",le=\"%s\"} %d\n",
+				label, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "wolpertinger_http_request_duration_seconds_bucket{handler=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "wolpertinger_http_request_duration_seconds_sum{handler=\"%s\"} %s\n", label, formatFloat(h.sum))
+		fmt.Fprintf(w, "wolpertinger_http_request_duration_seconds_count{handler=\"%s\"} %d\n", label, h.count)
+	}
+
+	results := make([]resultKey, 0, len(m.results))
+	for k := range m.results {
+		results = append(results, k)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].outcome != results[j].outcome {
+			return results[i].outcome < results[j].outcome
+		}
+		return !results[i].control && results[j].control
+	})
+	writeHeader(w, "wolpertinger_results_total", "Number of results that clients submitted, by outcome and measurement type.", "counter")
+	for _, k := range results {
+		fmt.Fprintf(w, "wolpertinger_results_total{outcome=\"%s\",control=\"%t\"} %d\n",
+			escapeLabel(k.outcome), k.control, m.results[k])
+	}
+}
+
+// statusRecorder wraps an http.ResponseWriter, and remembers the status code
+// of the response, and the organisation that made the request.
+type statusRecorder struct {
+	http.ResponseWriter
+	code         int
+	organisation string
+}
+
+// WriteHeader remembers the given status code before writing it.
+func (r *statusRecorder) WriteHeader(code int) {
+
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write remembers the implicit status code 200 before writing the given data.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// setOrganisation tells our metrics which organisation made the request whose
+// response the given writer represents.  Handlers call this once they
+// authenticated a request.
+func setOrganisation(w http.ResponseWriter, organisation string) {
+
+	if r, ok := w.(*statusRecorder); ok {
+		r.organisation = organisation
+	}
+}
+
+// instrument wraps the given handler, and records its requests and their
+// latency under the given name.
+func instrument(name string, h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		metrics.RequestServed(name, rec.organisation, rec.code, time.Since(start))
+	})
+}
+
+// MetricsHandler serves our metrics in Prometheus's text-based exposition
+// format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w, &bridges)
+}
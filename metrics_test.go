@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+
+	m := NewMetrics()
+	m.ReloadSucceeded(time.Unix(1600000000, 0))
+	m.ReloadFailed()
+	m.RequestServed("bridges", "foo", http.StatusOK, 20*time.Millisecond)
+	m.RequestServed("bridges", "foo", http.StatusOK, 2*time.Second)
+	m.RequestServed("bridges", "", http.StatusUnauthorized, time.Millisecond)
+	m.ResultReceived(&Result{Reachable: true})
+	m.ResultReceived(&Result{Reachable: false, Control: true})
+
+	bs := newTestBridges("A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE")
+	obfs4 := NewTransport()
+	obfs4.Type = BridgeTypeObfs4
+	bs.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"].AddTransport(obfs4)
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf, bs)
+	out := buf.String()
+
+	for _, line := range []string{
+		`wolpertinger_bridges{distributor="unallocated",transport="obfs4"} 1`,
+		`wolpertinger_bridges{distributor="unallocated",transport="vanilla"} 2`,
+		`wolpertinger_reloads_total{outcome="success"} 1`,
+		`wolpertinger_reloads_total{outcome="failure"} 1`,
+		`wolpertinger_last_reload_success_timestamp_seconds 1.6e+09`,
+		`wolpertinger_http_requests_total{handler="bridges",organisation="",code="401"} 1`,
+		`wolpertinger_http_requests_total{handler="bridges",organisation="foo",code="200"} 2`,
+		`wolpertinger_http_request_duration_seconds_bucket{handler="bridges",le="0.005"} 1`,
+		`wolpertinger_http_request_duration_seconds_bucket{handler="bridges",le="0.025"} 2`,
+		`wolpertinger_http_request_duration_seconds_bucket{handler="bridges",le="2.5"} 3`,
+		`wolpertinger_http_request_duration_seconds_bucket{handler="bridges",le="+Inf"} 3`,
+		`wolpertinger_http_request_duration_seconds_count{handler="bridges"} 3`,
+		`wolpertinger_results_total{outcome="reachable",control="false"} 1`,
+		`wolpertinger_results_total{outcome="unreachable",control="true"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics lack line %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+
+	metrics = NewMetrics()
+	h := instrument("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setOrganisation(w, "foo")
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if n := metrics.requests[requestKey{"test", "foo", http.StatusTeapot}]; n != 1 {
+		t.Errorf("expected 1 recorded request but got %d", n)
+	}
+	if h := metrics.latencies["test"]; h == nil || h.count != 1 {
+		t.Error("expected 1 recorded latency")
+	}
+}
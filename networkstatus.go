@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	RouterPrefix    = "r"
+	ORAddressPrefix = "a"
+	FlagsPrefix     = "s"
+
+	// RouterWords is the number of words in an 'r' line of a bridge
+	// networkstatus document.
+	RouterWords = 9
+
+	FlagRunning = "Running"
+	FlagStable  = "Stable"
+	FlagValid   = "Valid"
+)
+
+// ORAddress represents one of a bridge's additional ORPorts, e.g., its IPv6
+// ORPort.
+type ORAddress struct {
+	Address IPAddr `json:"address"`
+	Port    uint16 `json:"port"`
+}
+
+// decodeIdentity decodes the given Base64-encoded identity of an 'r' line,
+// whose padding is stripped, and returns it as upper-case hex-encoded
+// fingerprint.
+func decodeIdentity(identity string) (string, error) {
+
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(identity, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid identity %q: %s", identity, err)
+	}
+	if len(raw) != FingerprintLength/2 {
+		return "", fmt.Errorf("identity %q has %d instead of %d bytes", identity, len(raw), FingerprintLength/2)
+	}
+	return strings.ToUpper(hex.EncodeToString(raw)), nil
+}
+
+// parseRouterLine parses the given 'r' line of the format:
+//
+//	"r" nickname identity digest YYYY-MM-DD HH:MM:SS IP ORPort DirPort NL
+//
+// ...and returns a new bridge with the line's fingerprint, address, and
+// ORPort.
+func parseRouterLine(words []string) (*Bridge, error) {
+
+	if len(words) != RouterWords {
+		return nil, errors.New("incorrect number of words in 'r' line")
+	}
+	fingerprint, err := decodeIdentity(words[2])
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(words[6])
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", words[6])
+	}
+	port, err := strconv.ParseUint(words[7], 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid ORPort %q", words[7])
+	}
+
+	b := NewBridge()
+	b.Fingerprint = fingerprint
+	b.Address = IPAddr{net.IPAddr{IP: ip}}
+	b.Port = uint16(port)
+	// A bridge without 's' line has no flags, which differs from a bridge
+	// whose flags we don't know.
+	b.Flags = []string{}
+	return b, nil
+}
+
+// ParseNetworkstatusDoc parses the given bridge networkstatus document (i.e.,
+// the bridge authority's networkstatus-bridges file), and returns its bridges
+// with their flags and additional ORPorts.  We skip malformed lines and
+// entries, and report them in the returned ParseReport.  We only return an
+// error if we cannot read the document.
+func ParseNetworkstatusDoc(r io.Reader) (*Bridges, *ParseReport, error) {
+
+	var bridges = NewBridges()
+	var b *Bridge
+	report := newParseReport()
+	// skipping is set while we're inside an entry whose 'r' line is
+	// malformed.
+	skipping := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxDescriptorLineLength)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		// We're dealing with a new entry, i.e., a new bridge.
+		case RouterPrefix:
+			var err error
+			skipping = false
+			if b, err = parseRouterLine(words); err != nil {
+				report.skip(lineNum, "", err)
+				skipping = true
+				continue
+			}
+			bridges.Bridges[b.Fingerprint] = b
+
+		// We're dealing with one of the bridge's additional ORPorts.  There
+		// may be several.
+		case ORAddressPrefix:
+			if skipping {
+				report.Skipped[""]++
+				continue
+			}
+			if b == nil {
+				report.skip(lineNum, "", errors.New("'a' line outside of entry"))
+				continue
+			}
+			if len(words) != 2 {
+				report.skip(lineNum, b.Fingerprint, errors.New("incorrect number of words in 'a' line"))
+				continue
+			}
+			addr, port, err := parseAddrPort(words[1])
+			if err != nil {
+				report.skip(lineNum, b.Fingerprint, err)
+				continue
+			}
+			b.ORAddresses = append(b.ORAddresses, &ORAddress{Address: addr, Port: port})
+
+		// We're dealing with the bridge's flags.
+		case FlagsPrefix:
+			if skipping {
+				report.Skipped[""]++
+				continue
+			}
+			if b == nil {
+				report.skip(lineNum, "", errors.New("'s' line outside of entry"))
+				continue
+			}
+			b.Flags = append([]string{}, words[1:]...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("line %d: %s", lineNum+1, err)
+	}
+
+	return bridges, report, nil
+}
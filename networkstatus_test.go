@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNetworkstatusDoc(t *testing.T) {
+
+	doc := `published 2020-12-01 12:00:00
+flag-thresholds stable-uptime=1 stable-mtbf=1
+r foo oOxbD8UaXNgAudHRbTJWNrV1W84 AAAAAAAAAAAAAAAAAAAAAAAAAAA 2020-12-01 11:00:00 1.2.3.4 443 0
+a [2001:db8::1]:443
+a 1.2.3.5:9001
+s Fast Running Stable Valid
+w Bandwidth=1000
+p reject 1-65535
+r bar UVAt89F2zBDFLMZWlCBbuhheCYI AAAAAAAAAAAAAAAAAAAAAAAAAAA 2020-12-01 11:00:00 1.2.3.6 9001 0
+a bridge.example.com:443
+s Valid
+r baz tooshort AAAAAAAAAAAAAAAAAAAAAAAAAAA 2020-12-01 11:00:00 1.2.3.7 9001 0
+s Running
+`
+	bridges, report, err := ParseNetworkstatusDoc(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Failed to parse networkstatus document: %s", err)
+	}
+	if len(bridges.Bridges) != 2 {
+		t.Fatalf("Expected 2 bridges but got %d.", len(bridges.Bridges))
+	}
+
+	b, ok := bridges.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	if !ok {
+		t.Fatal("Failed to decode bridge identity.")
+	}
+	if b.Address.String() != "1.2.3.4" || b.Port != 443 {
+		t.Errorf("Failed to parse bridge's address and ORPort: %s", b)
+	}
+	if !reflect.DeepEqual(b.Flags, []string{"Fast", FlagRunning, FlagStable, FlagValid}) {
+		t.Errorf("Failed to parse bridge's flags: %v", b.Flags)
+	}
+	if !b.IsRunning() {
+		t.Error("Running bridge isn't running.")
+	}
+	if len(b.ORAddresses) != 2 || b.ORAddresses[0].Address.String() != "2001:db8::1" || b.ORAddresses[1].Port != 9001 {
+		t.Errorf("Failed to parse bridge's additional ORPorts: %v", b.ORAddresses)
+	}
+
+	b = bridges.Bridges["51502DF3D176CC10C52CC65694205BBA185E0982"]
+	if b == nil || b.IsRunning() || !b.HasFlag(FlagValid) {
+		t.Error("Failed to parse flags of bridge that isn't running.")
+	}
+	if len(b.ORAddresses) != 0 {
+		t.Error("Accepted additional ORPort with host name.")
+	}
+
+	if len(report.Errors) != 2 || report.Errors[0].Line != 10 || report.Errors[1].Line != 12 {
+		t.Errorf("Expected errors in lines 10 and 12 but got %v.", report.Errors)
+	}
+	if report.Skipped[""] != 2 {
+		t.Errorf("Expected 2 skipped lines of malformed entry but got %d.", report.Skipped[""])
+	}
+}
+
+func TestIsRunning(t *testing.T) {
+
+	b := NewBridge()
+	if !b.IsRunning() {
+		t.Error("Bridge with unknown flags isn't considered running.")
+	}
+	b.Flags = []string{}
+	if b.IsRunning() {
+		t.Error("Bridge without flags is considered running.")
+	}
+}
+
+func FuzzParseNetworkstatusDoc(f *testing.F) {
+
+	f.Add(`r foo oOxbD8UaXNgAudHRbTJWNrV1W84 AAAAAAAAAAAAAAAAAAAAAAAAAAA 2020-12-01 11:00:00 1.2.3.4 443 0
+a [2001:db8::1]:443
+s Running Valid
+`)
+	f.Add("s Running\na 1.2.3.4:443\nr foo\n")
+	f.Fuzz(func(t *testing.T, doc string) {
+		bridges, _, err := ParseNetworkstatusDoc(strings.NewReader(doc))
+		if err != nil {
+			return
+		}
+		for f, b := range bridges.Bridges {
+			if !isFingerprint(f) || f != b.Fingerprint {
+				t.Errorf("Invalid fingerprint %q.", f)
+			}
+			if b.Flags == nil {
+				t.Errorf("Bridge %s has unknown flags.", f)
+			}
+			for _, a := range b.ORAddresses {
+				if a.Address.IP == nil || a.Port == 0 {
+					t.Errorf("Accepted additional ORPort without address or port.")
+				}
+			}
+		}
+	})
+}
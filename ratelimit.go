@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitWindow = time.Minute
+	QuotaWindow     = 24 * time.Hour
+	// We discard counters whose window started longer ago than this.
+	CounterRetention = 2 * QuotaWindow
+
+	scopeOrgRequests    = "org-requests"
+	scopeClientRequests = "client-requests"
+	scopeOrgBridges     = "org-bridges"
+	scopeClientBridges  = "client-bridges"
+)
+
+// limiter enforces our rate limits and quotas.
+var limiter *Limiter
+
+// Limiter enforces per-organisation and per-client rate limits and quotas.
+// Its counters are stored in wolpertinger's counters table, so they survive
+// restarts.
+type Limiter struct {
+	m         sync.Mutex
+	db        *sql.DB
+	lastPrune time.Time
+}
+
+// counter represents one of our counters, e.g., the number of requests that
+// an organisation made in the current minute.
+type counter struct {
+	scope  string
+	key    string
+	limit  int
+	window time.Duration
+}
+
+// NewLimiter allocates and returns a new Limiter object that is backed by the
+// given database.  The database's schema must be up to date; see
+// MigrateDatabase.
+func NewLimiter(db *sql.DB) *Limiter {
+	return &Limiter{db: db}
+}
+
+// clientKey returns the key of the counters for the given client request.
+func clientKey(req *ClientRequest) string {
+	return req.Organisation + "\x00" + req.Id
+}
+
+// requestCounters returns the rate limit counters that apply to the given
+// request.
+func requestCounters(req *ClientRequest, org *OrgConfig) []counter {
+
+	var cs []counter
+	if org.RateLimit > 0 {
+		cs = append(cs, counter{scopeOrgRequests, req.Organisation, org.RateLimit, RateLimitWindow})
+	}
+	if org.ClientRateLimit > 0 {
+		cs = append(cs, counter{scopeClientRequests, clientKey(req), org.ClientRateLimit, RateLimitWindow})
+	}
+	return cs
+}
+
+// quotaCounters returns the quota counters that apply to the given request.
+func quotaCounters(req *ClientRequest, org *OrgConfig) []counter {
+
+	var cs []counter
+	if org.DailyQuota > 0 {
+		cs = append(cs, counter{scopeOrgBridges, req.Organisation, org.DailyQuota, QuotaWindow})
+	}
+	if org.ClientDailyQuota > 0 {
+		cs = append(cs, counter{scopeClientBridges, clientKey(req), org.ClientDailyQuota, QuotaWindow})
+	}
+	return cs
+}
+
+// retryAfter returns the time until the given counter's current window ends.
+func retryAfter(c counter, now time.Time) time.Duration {
+	return now.Truncate(c.window).Add(c.window).Sub(now)
+}
+
+// get returns the given counter's value in the current window.  The caller
+// must hold the lock.
+func (l *Limiter) get(c counter, now time.Time) (int, error) {
+
+	var count int
+	err := l.db.QueryRow(`SELECT count FROM WolpertingerCounters
+		WHERE scope = ? AND key = ? AND window_start = ?;`,
+		c.scope, c.key, now.Truncate(c.window).Unix()).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+// add adds the given delta to the given counter's value in the current
+// window.  The caller must hold the lock.
+func (l *Limiter) add(c counter, now time.Time, delta int) error {
+
+	_, err := l.db.Exec(`INSERT INTO WolpertingerCounters (scope, key, window_start, count)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (scope, key, window_start) DO UPDATE SET count = count + excluded.count;`,
+		c.scope, c.key, now.Truncate(c.window).Unix(), delta)
+	return err
+}
+
+// prune discards expired counters, at most once per rate limit window.  The
+// caller must hold the lock.
+func (l *Limiter) prune(now time.Time) error {
+
+	if now.Sub(l.lastPrune) < RateLimitWindow {
+		return nil
+	}
+	_, err := l.db.Exec("DELETE FROM WolpertingerCounters WHERE window_start < ?;",
+		now.Add(-CounterRetention).Unix())
+	if err == nil {
+		l.lastPrune = now
+	}
+	return err
+}
+
+// Allow determines if the given request is within its organisation's rate
+// limits and quotas.  If so, we count the request, reserve the number of
+// bridges (up to n) that we may hand out to the client, and return that
+// number.  If not, we return the time after which the client may try again.
+// We reserve bridges while holding our lock, so concurrent requests cannot
+// exceed a quota together.  Callers must give back the reserved bridges that
+// they ended up not handing out by calling Release.
+func (l *Limiter) Allow(req *ClientRequest, org *OrgConfig, n int, now time.Time) (int, time.Duration, error) {
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if err := l.prune(now); err != nil {
+		return 0, 0, err
+	}
+
+	requests := requestCounters(req, org)
+	for _, c := range requests {
+		count, err := l.get(c, now)
+		if err != nil {
+			return 0, 0, err
+		}
+		if count >= c.limit {
+			return 0, retryAfter(c, now), nil
+		}
+	}
+
+	allowed := n
+	quotas := quotaCounters(req, org)
+	for _, c := range quotas {
+		count, err := l.get(c, now)
+		if err != nil {
+			return 0, 0, err
+		}
+		if count >= c.limit {
+			return 0, retryAfter(c, now), nil
+		}
+		if c.limit-count < allowed {
+			allowed = c.limit - count
+		}
+	}
+
+	for _, c := range requests {
+		if err := l.add(c, now, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	for _, c := range quotas {
+		if err := l.add(c, now, allowed); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return allowed, 0, nil
+}
+
+// Release gives back the given number of bridges that Allow reserved for the
+// given request but that we didn't hand out, e.g., because we have fewer
+// bridges than the client asked for.  The given time must be the one that we
+// passed to Allow.
+func (l *Limiter) Release(req *ClientRequest, org *OrgConfig, unused int, now time.Time) error {
+
+	if unused <= 0 {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for _, c := range quotaCounters(req, org) {
+		if err := l.add(c, now, -unused); err != nil {
+			return err
+		}
+	}
+	return nil
+}
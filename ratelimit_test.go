@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+
+	db := openTestDB(t)
+	defer db.Close()
+	l := NewLimiter(db)
+	org := &OrgConfig{ClientRateLimit: 2, DailyQuota: 3}
+	req := &ClientRequest{Id: "1234", Organisation: "foo"}
+	now := time.Date(2020, 1, 1, 12, 0, 30, 0, time.UTC)
+
+	// Neither request hands out any of its reserved bridges.
+	for i := 0; i < 2; i++ {
+		n, wait, err := l.Allow(req, org, 2, now)
+		if err != nil {
+			t.Fatalf("Failed to check rate limit: %s", err)
+		}
+		if wait != 0 || n != 2 {
+			t.Fatalf("Rejected request %d that's within the rate limit.", i)
+		}
+		if err = l.Release(req, org, n, now); err != nil {
+			t.Fatalf("Failed to release quota: %s", err)
+		}
+	}
+	_, wait, _ := l.Allow(req, org, 2, now)
+	if wait != 30*time.Second {
+		t.Errorf("Expected to wait 30s but got %s.", wait)
+	}
+
+	// Another client of the same organisation has its own rate limit, but
+	// shares the daily quota.  Its request reserves two bridges, and hands
+	// out one of them.
+	other := &ClientRequest{Id: "4321", Organisation: "foo"}
+	n, wait, _ := l.Allow(other, org, 2, now)
+	if wait != 0 || n != 2 {
+		t.Fatal("Applied one client's rate limit to another client.")
+	}
+
+	// Concurrent requests mustn't exceed the quota together.
+	if n, _, _ = l.Allow(other, org, 2, now); n != 1 {
+		t.Errorf("Expected to be allowed 1 bridge while another request is pending but got %d.", n)
+	}
+	if err := l.Release(other, org, 1, now); err != nil {
+		t.Fatalf("Failed to release quota: %s", err)
+	}
+	now = now.Add(time.Minute)
+	if n, wait, _ = l.Allow(other, org, 2, now); wait != 0 || n != 1 {
+		t.Errorf("Expected to be allowed 1 bridge but got %d.", n)
+	}
+	if _, wait, _ = l.Allow(other, org, 2, now); wait != 12*time.Hour-time.Minute-30*time.Second {
+		t.Errorf("Expected to wait until midnight but got %s.", wait)
+	}
+
+	// Our counters must survive a restart.
+	l = NewLimiter(db)
+	if _, wait, _ = l.Allow(req, org, 2, now); wait == 0 {
+		t.Error("Lost quota counters after restart.")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// reloader reloads our bridges periodically, and on demand.
+var reloader = NewReloader(&bridges)
+
+// Reloader reloads a set of bridges from BridgeDB's SQLite database and the
+// extra-info file.  Reloads happen periodically (see Run), and on demand (see
+// Trigger and Reload).
+type Reloader struct {
+	// m serialises reloads, so an on-demand reload cannot race with a
+	// periodic one.
+	m       sync.Mutex
+	bs      *Bridges
+	trigger chan struct{}
+	// loaded is closed after our first successful reload, no matter if it
+	// was periodic or on demand.
+	loaded     chan struct{}
+	loadedOnce sync.Once
+}
+
+// NewReloader allocates and returns a new Reloader object that reloads the
+// given set of bridges.
+func NewReloader(bs *Bridges) *Reloader {
+	return &Reloader{
+		bs: bs,
+		// A trigger that arrives while a reload is pending is redundant, so
+		// one slot suffices.
+		trigger: make(chan struct{}, 1),
+		loaded:  make(chan struct{}),
+	}
+}
+
+// Loaded returns a channel that's closed once we successfully loaded bridges
+// for the first time, which allows callers to wait for our bridges before
+// serving requests.
+func (r *Reloader) Loaded() <-chan struct{} {
+	return r.loaded
+}
+
+// Reload reloads our bridges right away, and returns the number of bridges
+// that we loaded, and what we skipped in our sources.  If the reload fails, or
+// the given context is cancelled, we keep our old bridges.
+func (r *Reloader) Reload(ctx context.Context) (int, *LoadReport, error) {
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	newBridges, report, err := loadBridges(ctx, true)
+	if err != nil {
+		metrics.ReloadFailed()
+		return 0, nil, err
+	}
+	metrics.ReloadSucceeded(time.Now())
+	r.bs.Update(newBridges)
+	r.loadedOnce.Do(func() { close(r.loaded) })
+	return len(newBridges.Bridges), report, nil
+}
+
+// Trigger asks Run to reload our bridges as soon as possible, without waiting
+// for the reload to finish.
+func (r *Reloader) Trigger() {
+
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run reloads our bridges right away, and then every BridgeReloadInterval or
+// whenever somebody calls Trigger, until the given context is cancelled.
+func (r *Reloader) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(BridgeReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		n, _, err := r.Reload(ctx)
+		if err != nil {
+			log.Printf("Failed to load bridges: %s", err)
+		} else {
+			log.Printf("Successfully loaded %d bridges.", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
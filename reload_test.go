@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+
+	// Our sources don't exist, so each reload fails.
+	setConfig(&ConfigFile{
+		SqliteFile:    "/nonexistent/bridges.sqlite",
+		ExtrainfoFile: "/nonexistent/cached-extrainfo",
+	})
+	metrics = NewMetrics()
+	bs := newTestBridges("A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE")
+	r := NewReloader(bs)
+
+	if _, _, err := r.Reload(context.Background()); err == nil {
+		t.Fatal("expected reload with missing sources to fail")
+	}
+	if len(bs.Bridges) != 1 {
+		t.Error("failed reload must keep our old bridges")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(stopped)
+	}()
+
+	// Multiple triggers must not block, and must result in further reloads.
+	r.Trigger()
+	r.Trigger()
+	deadline := time.After(5 * time.Second)
+	for {
+		metrics.m.Lock()
+		failures := metrics.reloadFailures
+		metrics.m.Unlock()
+		if failures >= 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected at least 3 reloads but got %d", failures)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its context was cancelled")
+	}
+	select {
+	case <-r.Loaded():
+		t.Error("Run signalled a successful reload although all reloads failed")
+	default:
+	}
+}
+
+// writeTestSources creates a BridgeDB database with a single bridge and an
+// empty extra-info file in the given directory, points our configuration at
+// them, and sets up our results and usage history in the same database.
+func writeTestSources(t *testing.T, dir string, cfg *ConfigFile) *sql.DB {
+
+	cfg.SqliteFile = filepath.Join(dir, "bridges.sqlite")
+	cfg.ExtrainfoFile = filepath.Join(dir, "cached-extrainfo")
+	if err := ioutil.WriteFile(cfg.ExtrainfoFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(cfg.SqliteFile)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	if _, err = db.Exec(bridgeDBSchema); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	_, err = db.Exec(`INSERT INTO Bridges (hex_key, address, or_port, distributor, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?);`, "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.4", 443, "moat",
+		"2020-11-01 10:00", time.Now().UTC().Format(LastSeenLayout))
+	if err != nil {
+		t.Fatalf("failed to insert bridge: %s", err)
+	}
+	setConfig(cfg)
+	results = NewResults(db)
+	usage = NewUsageHistory(db)
+	return db
+}
+
+func TestReloadOnDemandOpensGate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first reload fails because our sources are missing.
+	adminToken := "KEWDlzJ7JLCBZ2dJ6pXa4P04aq0rbi1weJXGBAP0H/o="
+	cfg := &ConfigFile{ApiTokens: []ApiToken{ApiToken{Organisation: "ops", Token: adminToken, Admin: true}}}
+	cfg.SqliteFile = filepath.Join(dir, "missing.sqlite")
+	cfg.ExtrainfoFile = filepath.Join(dir, "missing-extrainfo")
+	setConfig(cfg)
+	metrics = NewMetrics()
+	oldReloader, oldResults, oldUsage := reloader, results, usage
+	defer func() { reloader, results, usage = oldReloader, oldResults, oldUsage }()
+	reloader = NewReloader(NewBridges())
+	if _, _, err = reloader.Reload(context.Background()); err == nil {
+		t.Fatal("expected reload with missing sources to fail")
+	}
+	gated := requireLoaded(reloader.Loaded(), http.HandlerFunc(HealthzHandler))
+	rec := httptest.NewRecorder()
+	gated.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridges", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d before loading bridges but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	// An operator fixes the sources and asks for a reload.
+	db := writeTestSources(t, dir, cfg)
+	defer db.Close()
+	req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec = httptest.NewRecorder()
+	AdminReloadHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d for reload but got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	gated.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/bridges", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d after reload on demand but got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestLoadBridgesRecordsUsage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldResults, oldUsage := results, usage
+	defer func() { results, usage = oldResults, oldUsage }()
+	cfg := &ConfigFile{}
+	db := writeTestSources(t, dir, cfg)
+	defer db.Close()
+	statsEnd := time.Now().UTC().Add(-time.Hour).Format("2006-01-02 15:04:05")
+	doc := "extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE\n" +
+		"bridge-stats-end " + statsEnd + " (86400 s)\n" +
+		"bridge-ips ir=16\n"
+	if err = ioutil.WriteFile(cfg.ExtrainfoFile, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	countStats := func() int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM WolpertingerBridgeStats;").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Exporting blocked bridges must not touch our usage history.
+	if _, _, err = loadBridges(context.Background(), false); err != nil {
+		t.Fatalf("failed to load bridges: %s", err)
+	}
+	if n := countStats(); n != 0 {
+		t.Errorf("expected no recorded reports but got %d", n)
+	}
+	if _, _, err = loadBridges(context.Background(), true); err != nil {
+		t.Fatalf("failed to load bridges: %s", err)
+	}
+	if n := countStats(); n != 1 {
+		t.Errorf("expected 1 recorded report but got %d", n)
+	}
+}
+
+func TestReloadReportsSkipped(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "wolpertinger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldReloader, oldResults, oldUsage := reloader, results, usage
+	defer func() { reloader, results, usage = oldReloader, oldResults, oldUsage }()
+	metrics = NewMetrics()
+	reloader = NewReloader(NewBridges())
+
+	adminToken := "KEWDlzJ7JLCBZ2dJ6pXa4P04aq0rbi1weJXGBAP0H/o="
+	cfg := &ConfigFile{ApiTokens: []ApiToken{ApiToken{Organisation: "ops", Token: adminToken, Admin: true}}}
+	db := writeTestSources(t, dir, cfg)
+	defer db.Close()
+	_, err = db.Exec(`INSERT INTO Bridges (hex_key, address, or_port, distributor, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?);`, "B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "not an address", 443, "moat",
+		"2020-11-01 10:00", time.Now().UTC().Format(LastSeenLayout))
+	if err != nil {
+		t.Fatalf("failed to insert bridge: %s", err)
+	}
+	doc := "extra-info foo A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE\n" +
+		"transport obfs4 1.2.3.4\n"
+	if err = ioutil.WriteFile(cfg.ExtrainfoFile, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	AdminReloadHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d for reload but got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	var resp ReloadResponse
+	if err = json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal reload response: %s", err)
+	}
+	if resp.Bridges != 1 || len(resp.Sources) != 2 {
+		t.Fatalf("expected 1 bridge and 2 sources but got %+v", resp)
+	}
+	for i, file := range []string{cfg.SqliteFile, cfg.ExtrainfoFile} {
+		s := resp.Sources[i]
+		if s.File != file || s.Skipped != 1 || len(s.Errors) != 1 {
+			t.Errorf("expected 1 skipped line and its error in %s but got %+v", file, s)
+		}
+	}
+	if n := resp.Sources[1].SkippedPerBridge["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]; n != 1 {
+		t.Errorf("expected 1 skipped line in the bridge's descriptor but got %d", n)
+	}
+}
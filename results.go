@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxResultSize = 1 << 16
+
+	OutcomeReachable   = "reachable"
+	OutcomeUnreachable = "unreachable"
+)
+
+var (
+	errUnknownBridge = errors.New("no bridge with the given ID")
+)
+
+// results holds all probe results that clients submitted to us.
+var results *Results
+
+// Result represents the outcome of a client's (e.g., an OONI probe's) attempt
+// to reach a bridge or one of its transports from a given location.
+type Result struct {
+	BridgeID  string `json:"bridge_id"`
+	ClientID  string `json:"id"`
+	ProbeType string `json:"type"`
+	Country   string `json:"country_code"`
+	ASN       int    `json:"asn"`
+	Reachable bool   `json:"reachable"`
+	// Control is set if the result is a control measurement from an
+	// uncensored vantage point.
+	Control bool      `json:"control"`
+	Time    time.Time `json:"-"`
+
+	// The following fields aren't set by the client.  We fill them in once we
+	// resolved the result's bridge ID.
+	Fingerprint string `json:"-"`
+	Transport   string `json:"-"`
+
+	// Organisation and TokenID identify the API token that the client
+	// submitted the result with.
+	Organisation string `json:"-"`
+	TokenID      string `json:"-"`
+}
+
+// Outcome returns the result's outcome as we store it in our database.
+func (r *Result) Outcome() string {
+	if r.Reachable {
+		return OutcomeReachable
+	}
+	return OutcomeUnreachable
+}
+
+// Results represents the set of probe results that we have on record.  The
+// results are stored in wolpertinger's results table, so they survive both
+// restarts and bridge reloads.
+type Results struct {
+	m  sync.Mutex
+	db *sql.DB
+}
+
+// NewResults allocates and returns a new Results object that is backed by the
+// given database.  The database's schema must be up to date; see
+// MigrateDatabase.
+func NewResults(db *sql.DB) *Results {
+	return &Results{db: db}
+}
+
+// Add resolves the given result's bridge ID, stores the result in our
+// database, and updates the blocking verdict of the matching bridge or
+// transport in the given set of bridges.  The given configuration determines
+// our bridges' IDs and our verdict policy.
+func (rs *Results) Add(cfg *ConfigFile, r *Result, bs *Bridges) error {
+
+	bs.m.Lock()
+	defer bs.m.Unlock()
+
+	b, t := bs.FindByID(cfg, r.BridgeID)
+	if b == nil {
+		return errUnknownBridge
+	}
+	r.Fingerprint = b.Fingerprint
+	r.Transport = BridgeTypeVanilla
+	if t != nil {
+		r.Transport = t.Type
+	}
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	_, err := rs.db.Exec(`INSERT INTO WolpertingerResults
+		(fingerprint, transport, country, asn, outcome, probe_type, probe_id, measured_at, control, organisation, token_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		r.Fingerprint, r.Transport, r.Country, r.ASN, r.Outcome(), r.ProbeType, r.ClientID, r.Time.Unix(), r.Control,
+		r.Organisation, r.TokenID)
+	if err != nil {
+		return err
+	}
+	if !r.Control && r.Time.After(b.LastTested[r.Country]) {
+		b.LastTested[r.Country] = r.Time
+	}
+
+	// Re-evaluate our verdict for the bridge (or transport) that the result is
+	// about.
+	policy := cfg.GetVerdictPolicy()
+	recent, err := rs.query(`WHERE fingerprint = ? AND transport = ? AND measured_at >= ?`,
+		r.Fingerprint, r.Transport, time.Now().Add(-policy.Window.Duration).Unix())
+	if err != nil {
+		return err
+	}
+	tgt := target{r.Fingerprint, r.Transport}
+	setBlockedIn(b, r.Transport, ComputeVerdicts(recent, policy)[tgt])
+
+	return nil
+}
+
+// ApplyTo attaches our results to the given set of bridges, i.e., the time of
+// each bridge's last test per country, and the locations in which we consider
+// bridges blocked, based on the given configuration's verdict policy.  We call
+// this after (re-)loading bridges, which would otherwise lose this information.
+func (rs *Results) ApplyTo(cfg *ConfigFile, bs *Bridges) error {
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	rows, err := rs.db.Query(`SELECT fingerprint, country, MAX(measured_at)
+		FROM WolpertingerResults WHERE control = 0 GROUP BY fingerprint, country;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fingerprint, country string
+		var measuredAt int64
+		if err = rows.Scan(&fingerprint, &country, &measuredAt); err != nil {
+			return err
+		}
+		if b, ok := bs.Bridges[fingerprint]; ok {
+			b.LastTested[country] = time.Unix(measuredAt, 0).UTC()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	policy := cfg.GetVerdictPolicy()
+	recent, err := rs.query(`WHERE measured_at >= ?`,
+		time.Now().Add(-policy.Window.Duration).Unix())
+	if err != nil {
+		return err
+	}
+	for tgt, locations := range ComputeVerdicts(recent, policy) {
+		if b, ok := bs.Bridges[tgt.Fingerprint]; ok {
+			setBlockedIn(b, tgt.Transport, locations)
+		}
+	}
+
+	return nil
+}
+
+// query returns the results that match the given WHERE clause, ordered by
+// time.  The caller must hold the lock.
+func (rs *Results) query(where string, args ...interface{}) ([]*Result, error) {
+
+	rows, err := rs.db.Query(`SELECT fingerprint, transport, country, asn, outcome, probe_type, probe_id, measured_at, control, organisation, token_id
+		FROM WolpertingerResults `+where+` ORDER BY measured_at, id;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs2 []*Result
+	for rows.Next() {
+		r, err := scanResult(rows)
+		if err != nil {
+			return nil, err
+		}
+		rs2 = append(rs2, r)
+	}
+	return rs2, rows.Err()
+}
+
+// scanResult turns the given row of our results table into a Result object.
+func scanResult(rows *sql.Rows) (*Result, error) {
+
+	var r Result
+	var outcome string
+	var measuredAt int64
+
+	err := rows.Scan(&r.Fingerprint, &r.Transport, &r.Country, &r.ASN,
+		&outcome, &r.ProbeType, &r.ClientID, &measuredAt, &r.Control, &r.Organisation, &r.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	r.Reachable = outcome == OutcomeReachable
+	r.Time = time.Unix(measuredAt, 0).UTC()
+
+	return &r, nil
+}
+
+// setBlockedIn sets the locations in which the given bridge's vanilla ORPort
+// (or its transport of the given type) is blocked.
+func setBlockedIn(b *Bridge, transport string, locations []*Location) {
+
+	if transport == BridgeTypeVanilla {
+		b.BlockedIn = locations
+		return
+	}
+	if t := b.GetTransport(transport); t != nil {
+		t.BlockedIn = locations
+	}
+}
+
+// isCountryCode returns 'true' if the given string looks like an ISO 3166-1
+// alpha-2 country code, i.e., consists of two ASCII letters in either case.
+func isCountryCode(s string) bool {
+
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// extractResult attempts to extract a Result object from the given JSON-encoded
+// request body.
+func extractResult(body io.Reader) (*Result, error) {
+
+	// We unmarshal into pointers first, which allows us to tell apart missing
+	// keys from zero values.
+	var raw struct {
+		BridgeID  *string `json:"bridge_id"`
+		ClientID  *string `json:"id"`
+		ProbeType *string `json:"type"`
+		Country   *string `json:"country_code"`
+		ASN       *int    `json:"asn"`
+		Reachable *bool   `json:"reachable"`
+		Control   bool    `json:"control"`
+	}
+	if err := json.NewDecoder(io.LimitReader(body, MaxResultSize)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %s", err)
+	}
+
+	if raw.BridgeID == nil || *raw.BridgeID == "" {
+		return nil, errors.New("key 'bridge_id' not found in result")
+	}
+	if raw.ClientID == nil {
+		return nil, errors.New("key 'id' not found in result")
+	}
+	if raw.ProbeType == nil || *raw.ProbeType == "" {
+		return nil, errors.New("key 'type' not found in result")
+	}
+	if raw.Country == nil || !isCountryCode(*raw.Country) {
+		return nil, errors.New("key 'country_code' must contain a two-letter country code")
+	}
+	if raw.ASN == nil || *raw.ASN < 0 {
+		return nil, errors.New("key 'asn' must contain a non-negative AS number")
+	}
+	if raw.Reachable == nil {
+		return nil, errors.New("key 'reachable' not found in result")
+	}
+
+	return &Result{
+		BridgeID:  *raw.BridgeID,
+		ClientID:  *raw.ClientID,
+		ProbeType: *raw.ProbeType,
+		Country:   strings.ToLower(*raw.Country),
+		ASN:       *raw.ASN,
+		Reachable: *raw.Reachable,
+		Control:   raw.Control,
+		Time:      time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExtractResult(t *testing.T) {
+
+	_, err := extractResult(bytes.NewBufferString(`{}`))
+	if err == nil {
+		t.Error("accepted result with no keys")
+	}
+
+	_, err = extractResult(bytes.NewBufferString(`{"bridge_id": "foo", "id": "1234", "type": "ooni", "country_code": "ru", "asn": 1234}`))
+	if err == nil {
+		t.Error("accepted result without reachability")
+	}
+
+	_, err = extractResult(bytes.NewBufferString(`{"bridge_id": "foo", "id": "1234", "type": "ooni", "country_code": "rus", "asn": 1234, "reachable": false}`))
+	if err == nil {
+		t.Error("accepted result with invalid country code")
+	}
+
+	for _, country := range []string{"!!", "r1", "r", "ру", "é"} {
+		_, err = extractResult(bytes.NewBufferString(`{"bridge_id": "foo", "id": "1234", "type": "ooni", "country_code": "` +
+			country + `", "asn": 1234, "reachable": false}`))
+		if err == nil {
+			t.Errorf("accepted result with invalid country code %q", country)
+		}
+	}
+
+	r, err := extractResult(bytes.NewBufferString(`{"bridge_id": "foo", "id": "", "type": "ooni", "country_code": "RU", "asn": 1234, "reachable": false}`))
+	if err != nil {
+		t.Fatalf("failed to accept valid result: %s", err)
+	}
+	if r.BridgeID != "foo" || r.ProbeType != "ooni" || r.ASN != 1234 || r.Reachable {
+		t.Error("failed to parse result")
+	}
+	if r.Country != "ru" {
+		t.Error("failed to normalise country code")
+	}
+}
+
+func TestFindByID(t *testing.T) {
+
+	bs := NewBridges()
+	b := NewBridge()
+	b.Fingerprint = "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"
+	b.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	b.Port = 443
+	tr := NewTransport()
+	tr.Type = BridgeTypeObfs4
+	tr.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	tr.Port = 1234
+	b.AddTransport(tr)
+	bs.Add(b)
+
+	oldKey := &ConfigFile{MasterKey: "old"}
+	if found, t2 := bs.FindByID(oldKey, b.GetID(oldKey)); found != b || t2 != nil {
+		t.Error("failed to find bridge by its ID")
+	}
+	if found, t2 := bs.FindByID(oldKey, tr.GetID(oldKey)); found != b || t2 != tr {
+		t.Error("failed to find transport by its ID")
+	}
+	if found, t2 := bs.FindByID(oldKey, "foo"); found != nil || t2 != nil {
+		t.Error("found bridge for unknown ID")
+	}
+
+	// A new master key gives our bridges new IDs.
+	newKey := &ConfigFile{MasterKey: "new"}
+	if found, _ := bs.FindByID(newKey, b.GetID(oldKey)); found != nil {
+		t.Error("found bridge by its ID under the old master key")
+	}
+	if found, _ := bs.FindByID(newKey, b.GetID(newKey)); found != b {
+		t.Error("failed to find bridge by its ID under the new master key")
+	}
+
+	// Updating our bridges updates our index.
+	setConfig(newKey)
+	other := newTestBridges("B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE")
+	bs.Update(other)
+	if found, _ := bs.FindByID(newKey, b.GetID(newKey)); found != nil {
+		t.Error("found bridge that we no longer have")
+	}
+	b2 := other.Bridges["B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	if found, _ := bs.FindByID(newKey, b2.GetID(newKey)); found != b2 {
+		t.Error("failed to find updated bridge by its ID")
+	}
+}
+
+func TestAddResult(t *testing.T) {
+
+	bs := NewBridges()
+	b := NewBridge()
+	b.Fingerprint = "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"
+	b.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	b.Port = 443
+	tr := NewTransport()
+	tr.Type = BridgeTypeObfs4
+	tr.Address = IPAddr{net.IPAddr{IP: net.ParseIP("1.2.3.4")}}
+	tr.Port = 1234
+	b.AddTransport(tr)
+	bs.Add(b)
+
+	// Let a single failure suffice to mark a bridge as blocked, even without
+	// control measurements.
+	requireControl := false
+	setConfig(&ConfigFile{Verdict: VerdictPolicy{MinProbes: 1, FailureRatio: 0.8, RequireControl: &requireControl}})
+	db := openTestDB(t)
+	defer db.Close()
+	rs := NewResults(db)
+	now := time.Now()
+	if err := rs.Add(getConfig(), &Result{BridgeID: "foo"}, bs); err != errUnknownBridge {
+		t.Error("accepted result for unknown bridge")
+	}
+
+	if err := rs.Add(getConfig(), &Result{BridgeID: tr.GetID(getConfig()), Country: "ru", Time: now}, bs); err != nil {
+		t.Fatalf("failed to add result: %s", err)
+	}
+	if len(tr.BlockedIn) != 1 || tr.BlockedIn[0].Country != "ru" {
+		t.Error("failed to mark transport as blocked")
+	}
+	if len(b.BlockedIn) != 0 {
+		t.Error("marked bridge as blocked instead of its transport")
+	}
+
+	if err := rs.Add(getConfig(), &Result{BridgeID: b.GetID(getConfig()), Country: "cn", Time: now, Organisation: "foo", TokenID: "1"}, bs); err != nil {
+		t.Fatalf("failed to add result: %s", err)
+	}
+	if len(b.BlockedIn) != 1 || b.BlockedIn[0].Country != "cn" {
+		t.Error("failed to mark bridge as blocked")
+	}
+
+	if err := rs.Add(getConfig(), &Result{BridgeID: tr.GetID(getConfig()), Country: "ru", Reachable: true, Time: now}, bs); err != nil {
+		t.Fatalf("failed to add result: %s", err)
+	}
+	if len(tr.BlockedIn) != 0 {
+		t.Error("failed to mark transport as unblocked")
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM WolpertingerResults;").Scan(&count); err != nil {
+		t.Fatalf("failed to count results: %s", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 stored results but got %d", count)
+	}
+	var org, tokenID string
+	err := db.QueryRow("SELECT organisation, token_id FROM WolpertingerResults WHERE country = 'cn';").Scan(&org, &tokenID)
+	if err != nil {
+		t.Fatalf("failed to query result: %s", err)
+	}
+	if org != "foo" || tokenID != "1" {
+		t.Errorf("expected organisation and token ID to be stored but got %q and %q", org, tokenID)
+	}
+
+	// Results must survive a reload of our bridges.
+	b2 := NewBridge()
+	b2.Fingerprint = b.Fingerprint
+	b2.Address = b.Address
+	b2.Port = b.Port
+	newBs := NewBridges()
+	newBs.Add(b2)
+	if err := rs.ApplyTo(getConfig(), newBs); err != nil {
+		t.Fatalf("failed to apply results: %s", err)
+	}
+	if len(b2.BlockedIn) != 1 || b2.BlockedIn[0].Country != "cn" {
+		t.Error("failed to re-apply results to reloaded bridge")
+	}
+	if !b2.LastTested["cn"].Equal(now.Truncate(time.Second)) {
+		t.Error("failed to re-apply time of last test to reloaded bridge")
+	}
+}
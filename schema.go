@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations contains the SQL statements that create and update the tables
+// that wolpertinger owns.  These tables live next to BridgeDB's tables in the
+// same SQLite database.  Migration i brings the schema from version i to i+1.
+// Never change existing migrations; append new ones instead.
+var migrations = []string{
+	`CREATE TABLE WolpertingerResults (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		fingerprint TEXT NOT NULL,
+		transport TEXT NOT NULL,
+		country TEXT NOT NULL,
+		asn INTEGER NOT NULL,
+		outcome TEXT NOT NULL,
+		probe_type TEXT NOT NULL,
+		probe_id TEXT NOT NULL,
+		measured_at INTEGER NOT NULL
+	);
+	CREATE INDEX WolpertingerResultsBridge ON WolpertingerResults (fingerprint, transport);
+	CREATE INDEX WolpertingerResultsTime ON WolpertingerResults (measured_at);`,
+
+	`ALTER TABLE WolpertingerResults ADD COLUMN control INTEGER NOT NULL DEFAULT 0;`,
+
+	`CREATE TABLE WolpertingerCounters (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		window_start INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (scope, key, window_start)
+	);`,
+
+	`CREATE TABLE WolpertingerBridgeStats (
+		fingerprint TEXT NOT NULL,
+		stats_end INTEGER NOT NULL,
+		interval INTEGER NOT NULL,
+		PRIMARY KEY (fingerprint, stats_end)
+	);
+	CREATE TABLE WolpertingerBridgeUsage (
+		fingerprint TEXT NOT NULL,
+		stats_end INTEGER NOT NULL,
+		country TEXT NOT NULL,
+		clients INTEGER NOT NULL,
+		PRIMARY KEY (fingerprint, stats_end, country)
+	);
+	CREATE INDEX WolpertingerBridgeUsageTime ON WolpertingerBridgeUsage (stats_end);`,
+
+	`ALTER TABLE WolpertingerResults ADD COLUMN organisation TEXT NOT NULL DEFAULT '';
+	ALTER TABLE WolpertingerResults ADD COLUMN token_id TEXT NOT NULL DEFAULT '';`,
+}
+
+// schemaVersion returns the version of wolpertinger's schema in the given
+// database.  A version of 0 means that the database has no wolpertinger tables
+// yet.
+func schemaVersion(db *sql.DB) (int, error) {
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS WolpertingerSchema (
+		version INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	);`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM WolpertingerSchema;").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// MigrateDatabase brings wolpertinger's tables in the given database up to
+// date.  Each migration runs in its own transaction, so a failed migration
+// leaves the database at the last successful version.
+func MigrateDatabase(db *sql.DB) error {
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than what we support (%d)",
+			version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate schema to version %d: %s", version+1, err)
+		}
+		_, err = tx.Exec("INSERT INTO WolpertingerSchema (version, applied_at) VALUES (?, ?);",
+			version+1, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Migrated database schema to version %d.", version+1)
+	}
+
+	return nil
+}
+
+// OpenDatabase opens the SQLite database at the given path and brings
+// wolpertinger's tables up to date.
+func OpenDatabase(filename string) (*sql.DB, error) {
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = MigrateDatabase(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
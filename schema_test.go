@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// openTestDB returns a new, migrated in-memory SQLite database.  We limit the
+// pool to a single connection because each connection to ":memory:" would
+// otherwise get its own, empty database.
+func openTestDB(t *testing.T) *sql.DB {
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open in-memory database: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = MigrateDatabase(db); err != nil {
+		t.Fatalf("Failed to migrate in-memory database: %s", err)
+	}
+	return db
+}
+
+func TestMigrateDatabase(t *testing.T) {
+
+	db := openTestDB(t)
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatalf("Failed to determine schema version: %s", err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d but got %d.", len(migrations), version)
+	}
+
+	// Running our migrations again must be a no-op.
+	if err = MigrateDatabase(db); err != nil {
+		t.Errorf("Failed to re-run migrations: %s", err)
+	}
+
+	_, err = db.Exec("INSERT INTO WolpertingerSchema (version, applied_at) VALUES (?, 0);", len(migrations)+1)
+	if err != nil {
+		t.Fatalf("Failed to bump schema version: %s", err)
+	}
+	if err = MigrateDatabase(db); err == nil {
+		t.Error("Failed to reject schema version that's newer than ours.")
+	}
+}
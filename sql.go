@@ -1,72 +1,172 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net"
-	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
+	// LastSeenLayout is the layout of the timestamps in BridgeDB's
+	// 'first_seen' and 'last_seen' columns.  BridgeDB stores them in UTC.
 	LastSeenLayout = "2006-01-02 15:04"
+
+	// BridgeDBTable is the name of BridgeDB's table that contains bridges.
+	BridgeDBTable = "Bridges"
 )
 
-func LoadDatabase(db *sql.DB) (*Bridges, error) {
+// bridgeDBColumns contains the columns of BridgeDB's Bridges table that we
+// read, in the order in which we scan them.
+var bridgeDBColumns = []string{"hex_key", "address", "or_port", "distributor", "first_seen", "last_seen"}
+
+// parseSeen parses the given timestamp of BridgeDB's 'first_seen' or
+// 'last_seen' column.
+func parseSeen(column, value string) (time.Time, error) {
 
-	// Figure out the latest 'last_seen' value, which allows us to select only
-	// bridges that are currently online.
-	var latest string
-	rows, err := db.Query("SELECT last_seen FROM Bridges ORDER BY last_seen DESC LIMIT 1;")
+	t, err := time.Parse(LastSeenLayout, value)
 	if err != nil {
-		return nil, err
+		return time.Time{}, fmt.Errorf("failed to parse %s: %s", column, err)
+	}
+	return t, nil
+}
+
+// CheckBridgeDBSchema returns an error that names the missing columns if
+// BridgeDB's Bridges table lacks any of the columns that we read.
+func CheckBridgeDBSchema(db *sql.DB) error {
+
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?);", BridgeDBTable)
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
+
+	existing := make(map[string]bool)
 	for rows.Next() {
-		if err = rows.Scan(&latest); err != nil {
-			return nil, err
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
 		}
+		existing[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
 	}
 
-	// Now select the actual bridges.
-	query := fmt.Sprintf("SELECT * FROM Bridges WHERE last_seen = '%s' AND or_port IS NOT NULL;", latest)
-	rows, err = db.Query(query)
-	if err != nil {
-		return nil, err
+	if len(existing) == 0 {
+		return fmt.Errorf("database has no table %q", BridgeDBTable)
 	}
-	defer rows.Close()
+	var missing []string
+	for _, column := range bridgeDBColumns {
+		if !existing[column] {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("table %q lacks columns: %s", BridgeDBTable, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// DatabaseReport tells us which bridges we left out when loading BridgeDB's
+// database.
+type DatabaseReport struct {
+	// Stale is the number of bridges that we excluded because BridgeDB
+	// didn't see them within our freshness window, i.e., bridges that went
+	// offline.
+	Stale int
+	// Errors contains an error for each row that we skipped because it's
+	// malformed.
+	Errors []error
+}
+
+// LoadDatabase loads the bridges that BridgeDB saw within the given freshness
+// window from the given database.  We return the loaded bridges, and a report
+// that counts the bridges that we excluded because BridgeDB didn't see them
+// within the window, and the malformed rows that we skipped.  BridgeDB never
+// deletes bridges, so we leave it to SQLite to skip the bulk of its history.
+// Cancelling the given context aborts our queries.
+func LoadDatabase(ctx context.Context, db *sql.DB, window time.Duration) (*Bridges, *DatabaseReport, error) {
 
+	if err := CheckBridgeDBSchema(db); err != nil {
+		return nil, nil, err
+	}
+
+	// We only keep bridges that BridgeDB saw within our freshness window,
+	// i.e., bridges that are presumably still online.  If BridgeDB stops
+	// updating its database, we therefore end up without bridges, and
+	// /readyz tells our operators.  BridgeDB's timestamps are in UTC, and
+	// sort lexicographically, so we can compare them as strings.
 	var bridges = NewBridges()
-	var b *Bridge
-	var id, fingerprint, address, port, distributor, first_seen, last_seen string
+	var report = &DatabaseReport{}
+	cutoff := time.Now().UTC().Add(-window).Format(LastSeenLayout)
+
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE or_port IS NOT NULL AND last_seen < ?;",
+		BridgeDBTable), cutoff).Scan(&report.Stale)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE last_seen >= ? AND or_port IS NOT NULL;",
+		strings.Join(bridgeDBColumns, ", "), BridgeDBTable), cutoff)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
 
 	for rows.Next() {
-		b = NewBridge()
-		err = rows.Scan(&id, &fingerprint, &address, &port, &distributor, &first_seen, &last_seen)
-		if err != nil {
-			return nil, err
+		// BridgeDB doesn't declare its columns NOT NULL, so any of them
+		// may be NULL.
+		var columns = make([]sql.NullString, len(bridgeDBColumns))
+		var dest = make([]interface{}, len(columns))
+		for i := range columns {
+			dest[i] = &columns[i]
 		}
-		b.Fingerprint = fingerprint
-		b.Distributor = distributor
-
-		a, err := net.ResolveIPAddr("", address)
-		if err != nil {
-			return nil, err
+		if err = rows.Scan(dest...); err != nil {
+			return nil, nil, err
 		}
-		b.Address = IPAddr{net.IPAddr{a.IP, a.Zone}}
-		p, err := strconv.Atoi(port)
+		b, err := parseBridgeDBRow(columns)
 		if err != nil {
-			return nil, err
+			report.Errors = append(report.Errors, err)
+			continue
 		}
-		b.Port = uint16(p)
-
 		bridges.Bridges[b.Fingerprint] = b
 	}
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return bridges, report, nil
+}
+
+// parseBridgeDBRow turns the given row of BridgeDB's Bridges table, whose
+// columns are in the order of bridgeDBColumns, into a bridge.  We return an
+// error if the row is malformed.
+func parseBridgeDBRow(columns []sql.NullString) (*Bridge, error) {
+
+	fingerprint := columns[0].String
+	for i, c := range columns {
+		if !c.Valid {
+			return nil, fmt.Errorf("bridge %q: %s is NULL", fingerprint, bridgeDBColumns[i])
+		}
 	}
 
-	return bridges, nil
+	var err error
+	b := NewBridge()
+	b.Fingerprint = fingerprint
+	b.Distributor = columns[3].String
+	if b.FirstSeen, err = parseSeen("first_seen", columns[4].String); err != nil {
+		return nil, fmt.Errorf("bridge %q: %s", fingerprint, err)
+	}
+	if b.LastSeen, err = parseSeen("last_seen", columns[5].String); err != nil {
+		return nil, fmt.Errorf("bridge %q: %s", fingerprint, err)
+	}
+	if b.Address, b.Port, err = parseAddrPort(net.JoinHostPort(columns[1].String, columns[2].String)); err != nil {
+		return nil, fmt.Errorf("bridge %q: %s", fingerprint, err)
+	}
+	return b, nil
 }
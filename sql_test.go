@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openBridgeDBFixture returns an in-memory database with BridgeDB's Bridges
+// table, which contains the given rows.
+func openBridgeDBFixture(t *testing.T, schema string, rows ...[]interface{}) *sql.DB {
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	// Each connection to ":memory:" has its own database.
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(schema); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	for _, row := range rows {
+		_, err = db.Exec(`INSERT INTO Bridges (hex_key, address, or_port, distributor, first_seen, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?);`, row...)
+		if err != nil {
+			t.Fatalf("failed to insert bridge: %s", err)
+		}
+	}
+	return db
+}
+
+// bridgeDBSchema is BridgeDB's schema of its Bridges table.
+const bridgeDBSchema = `CREATE TABLE Bridges (
+	id INTEGER PRIMARY KEY NOT NULL,
+	hex_key, address, or_port, distributor, first_seen, last_seen,
+	UNIQUE (hex_key));`
+
+// seenAgo returns the given duration before the current time in BridgeDB's
+// timestamp format.
+func seenAgo(d time.Duration) string {
+	return time.Now().UTC().Add(-d).Format(LastSeenLayout)
+}
+
+func TestLoadDatabase(t *testing.T) {
+
+	lastSeen := seenAgo(5 * time.Minute)
+	db := openBridgeDBFixture(t, bridgeDBSchema,
+		[]interface{}{"A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.4", 443, "moat", "2020-11-01 10:00", lastSeen},
+		[]interface{}{"B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "2001:db8::1", 9001, "unallocated", "2020-11-02 10:00", lastSeen},
+		// This bridge went offline, and this one has no ORPort.
+		[]interface{}{"C0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.5", 443, "https", "2020-11-01 10:00", seenAgo(90 * time.Minute)},
+		[]interface{}{"D0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.6", nil, "https", "2020-11-01 10:00", lastSeen},
+	)
+	defer db.Close()
+
+	bs, report, err := LoadDatabase(context.Background(), db, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load bridges: %s", err)
+	}
+	if len(bs.Bridges) != 2 || report.Stale != 1 {
+		t.Fatalf("expected 2 bridges and 1 stale bridge but got %d and %d", len(bs.Bridges), report.Stale)
+	}
+	b, ok := bs.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]
+	if !ok {
+		t.Fatal("failed to load bridge")
+	}
+	if b.Address.String() != "1.2.3.4" || b.Port != 443 || b.Distributor != DistributorMoat {
+		t.Errorf("unexpected bridge: %s", b)
+	}
+	if !b.FirstSeen.Equal(time.Date(2020, 11, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first_seen: %s", b.FirstSeen)
+	}
+	if b.LastSeen.Format(LastSeenLayout) != lastSeen {
+		t.Errorf("unexpected last_seen: %s", b.LastSeen)
+	}
+	if b := bs.Bridges["B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"]; b == nil || b.Address.String() != "2001:db8::1" {
+		t.Error("failed to load IPv6 bridge")
+	}
+
+	// A cancelled reload must not load anything.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = LoadDatabase(ctx, db, time.Hour); err == nil {
+		t.Error("loaded bridges despite cancelled context")
+	}
+
+	// Unlike BridgeDB, our fixture has an empty table.
+	empty := openBridgeDBFixture(t, bridgeDBSchema)
+	defer empty.Close()
+	if bs, _, err = LoadDatabase(context.Background(), empty, time.Hour); err != nil {
+		t.Errorf("failed to load bridges from empty table: %s", err)
+	} else if len(bs.Bridges) != 0 {
+		t.Errorf("expected no bridges but got %d", len(bs.Bridges))
+	}
+}
+
+func TestLoadDatabaseFreshness(t *testing.T) {
+
+	db := openBridgeDBFixture(t, bridgeDBSchema,
+		[]interface{}{"A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.4", 443, "moat", "2020-11-01 10:00", seenAgo(0)},
+		[]interface{}{"B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.5", 443, "moat", "2020-11-01 10:00", seenAgo(30 * time.Minute)},
+		[]interface{}{"C0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.6", 443, "moat", "2020-11-01 10:00", seenAgo(2 * time.Hour)},
+		[]interface{}{"D0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.7", 443, "moat", "2020-11-01 10:00", seenAgo(6 * time.Hour)},
+		// BridgeDB remembers bridges that went offline long ago.
+		[]interface{}{"E0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.8", 443, "moat", "2020-11-01 10:00", "2020-11-02 10:00"},
+	)
+	defer db.Close()
+
+	for _, test := range []struct {
+		window  time.Duration
+		bridges int
+		stale   int
+	}{
+		{10 * time.Minute, 1, 4},
+		{time.Hour, 2, 3},
+		{4 * time.Hour, 3, 2},
+		{24 * time.Hour, 4, 1},
+	} {
+		bs, report, err := LoadDatabase(context.Background(), db, test.window)
+		if err != nil {
+			t.Fatalf("failed to load bridges: %s", err)
+		}
+		if len(bs.Bridges) != test.bridges || report.Stale != test.stale {
+			t.Errorf("expected %d bridges and %d stale bridges within %s but got %d and %d",
+				test.bridges, test.stale, test.window, len(bs.Bridges), report.Stale)
+		}
+	}
+
+	// If BridgeDB stops updating its database, its bridges go stale.
+	old := openBridgeDBFixture(t, bridgeDBSchema,
+		[]interface{}{"A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.4", 443, "moat", "2020-11-01 10:00", seenAgo(3 * time.Hour)},
+	)
+	defer old.Close()
+	bs, report, err := LoadDatabase(context.Background(), old, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load bridges: %s", err)
+	}
+	if len(bs.Bridges) != 0 || report.Stale != 1 {
+		t.Errorf("expected no bridges and 1 stale bridge but got %d and %d", len(bs.Bridges), report.Stale)
+	}
+}
+
+func TestLoadDatabaseMalformedRows(t *testing.T) {
+
+	lastSeen := seenAgo(5 * time.Minute)
+	db := openBridgeDBFixture(t, bridgeDBSchema,
+		[]interface{}{"A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.4", 443, "moat", "2020-11-01 10:00", lastSeen},
+		[]interface{}{"B0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.5", 443, "moat", "yesterday", lastSeen},
+		[]interface{}{"C0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.6", 443, "moat", "2020-11-01 10:00", lastSeen + ":00"},
+		[]interface{}{"D0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "not an address", 443, "moat", "2020-11-01 10:00", lastSeen},
+		[]interface{}{"E0EC5B0FC51A5CD800B9D1D16D325636B5755BCE", "1.2.3.7", 443, nil, "2020-11-01 10:00", lastSeen},
+		[]interface{}{nil, "1.2.3.8", 443, "moat", "2020-11-01 10:00", lastSeen},
+	)
+	defer db.Close()
+
+	bs, report, err := LoadDatabase(context.Background(), db, time.Hour)
+	if err != nil {
+		t.Fatalf("malformed rows made us give up: %s", err)
+	}
+	if len(bs.Bridges) != 1 || bs.Bridges["A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"] == nil {
+		t.Errorf("expected only the well-formed bridge but got %d bridges", len(bs.Bridges))
+	}
+	if len(report.Errors) != 5 {
+		t.Errorf("expected 5 skipped rows but got %d: %v", len(report.Errors), report.Errors)
+	}
+}
+
+func TestCheckBridgeDBSchema(t *testing.T) {
+
+	db := openBridgeDBFixture(t, bridgeDBSchema)
+	defer db.Close()
+	if err := CheckBridgeDBSchema(db); err != nil {
+		t.Errorf("rejected BridgeDB's schema: %s", err)
+	}
+
+	// Additional columns in any order are fine.
+	db = openBridgeDBFixture(t, `CREATE TABLE Bridges (last_seen, first_seen, distributor,
+		or_port, address, hex_key, blocking_status);`)
+	defer db.Close()
+	if err := CheckBridgeDBSchema(db); err != nil {
+		t.Errorf("rejected schema with additional columns: %s", err)
+	}
+
+	missing, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+	missing.SetMaxOpenConns(1)
+	if _, err = missing.Exec("CREATE TABLE Bridges (hex_key, address, distributor, last_seen);"); err != nil {
+		t.Fatal(err)
+	}
+	err = CheckBridgeDBSchema(missing)
+	if err == nil || !strings.Contains(err.Error(), "or_port, first_seen") {
+		t.Errorf("expected error about missing columns but got %v", err)
+	}
+	if _, _, err = LoadDatabase(context.Background(), missing, time.Hour); err == nil {
+		t.Error("loaded bridges from table with missing columns")
+	}
+
+	ours := openTestDB(t)
+	defer ours.Close()
+	if err = CheckBridgeDBSchema(ours); err == nil || !strings.Contains(err.Error(), "no table") {
+		t.Errorf("expected error about missing table but got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxBridgeAge caps the age of a bridge (i.e., the time since BridgeDB
+	// first saw it) when weighing bridges, so that a few very old bridges
+	// don't crowd out all others.
+	MaxBridgeAge = 365 * 24 * time.Hour
+
+	DefaultAssignmentEpoch = 24 * time.Hour
+)
+
+// rng is our source of randomness for bridge selection.  A *rand.Rand isn't
+// safe for concurrent use, so we guard it with a mutex.
+var rng = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// shuffle randomly shuffles the given bridges in place.
+func shuffle(bs []*Bridge) {
+
+	rng.Lock()
+	rng.Shuffle(len(bs), func(i, j int) {
+		bs[i], bs[j] = bs[j], bs[i]
+	})
+	rng.Unlock()
+}
+
+// firstN returns up to the first n of the given bridges.
+func firstN(bs []*Bridge, n int) []*Bridge {
+	if len(bs) > n {
+		return bs[:n]
+	}
+	return bs
+}
+
+// LeastRecentlyTestedDistributor prefers bridges that haven't been tested
+// from the client's country for the longest time.
+type LeastRecentlyTestedDistributor struct{}
+
+// Select implements the Distributor interface.
+func (d *LeastRecentlyTestedDistributor) Select(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int) []*Bridge {
+
+	// Shuffle our candidates first, so we don't hand out the same bridges to
+	// all clients if several bridges have never been tested.
+	shuffle(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].LastTested[req.Location].Before(candidates[j].LastTested[req.Location])
+	})
+
+	return firstN(candidates, n)
+}
+
+// RoundRobinDistributor cycles through all candidate bridges, ordered by
+// fingerprint, so that each bridge gets handed out equally often.
+type RoundRobinDistributor struct {
+	m    sync.Mutex
+	last string // The fingerprint of the last bridge that we handed out.
+}
+
+// Select implements the Distributor interface.
+func (d *RoundRobinDistributor) Select(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int) []*Bridge {
+
+	if len(candidates) == 0 || n <= 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Fingerprint < candidates[j].Fingerprint
+	})
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	// Continue after the last bridge that we handed out.  Our set of
+	// candidates changes from request to request, so we search for the
+	// position rather than remembering an index.
+	start := sort.Search(len(candidates), func(i int) bool {
+		return candidates[i].Fingerprint > d.last
+	})
+
+	var selected []*Bridge
+	for i := 0; i < len(candidates) && i < n; i++ {
+		selected = append(selected, candidates[(start+i)%len(candidates)])
+	}
+	d.last = selected[len(selected)-1].Fingerprint
+
+	return selected
+}
+
+// RandomByAgeDistributor picks bridges at random, weighted by their age, i.e.,
+// by how long ago BridgeDB first saw them: the older the bridge, the more
+// likely we pick it.  Old bridges had more time to get enumerated by censors,
+// so they're the most likely to be blocked.
+type RandomByAgeDistributor struct{}
+
+// Select implements the Distributor interface.
+func (d *RandomByAgeDistributor) Select(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int) []*Bridge {
+
+	now := time.Now()
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, b := range candidates {
+		var age time.Duration
+		if !b.FirstSeen.IsZero() {
+			age = now.Sub(b.FirstSeen)
+		}
+		if age < 0 {
+			age = 0
+		} else if age > MaxBridgeAge {
+			age = MaxBridgeAge
+		}
+		// Add one, so that new bridges (and bridges whose age we don't know)
+		// still have a small chance of getting picked.
+		weights[i] = age.Hours() + 1
+		total += weights[i]
+	}
+
+	rng.Lock()
+	defer rng.Unlock()
+
+	// Sample without replacement.
+	var selected []*Bridge
+	for len(selected) < n && len(selected) < len(candidates) && total > 0 {
+		x := rng.Float64() * total
+		i := 0
+		for ; i < len(weights)-1; i++ {
+			if x < weights[i] {
+				break
+			}
+			x -= weights[i]
+		}
+		if weights[i] == 0 {
+			// Floating point imprecision got us past the last non-zero
+			// weight.
+			continue
+		}
+		selected = append(selected, candidates[i])
+		total -= weights[i]
+		weights[i] = 0
+	}
+
+	return selected
+}
+
+// StableAssignmentDistributor hands out the same bridges to a client for the
+// duration of an epoch, no matter how often the client asks, which makes it
+// hard to enumerate our bridges by posing as a probe.  We place bridges and
+// clients on a hash ring that's keyed with our master key and the current
+// epoch.  A client gets the bridges that follow its position on the ring.
+// The client's position depends on its organisation, ID, and country.
+type StableAssignmentDistributor struct{}
+
+// ringEntry represents a bridge on our hash ring.
+type ringEntry struct {
+	position string
+	bridge   *Bridge
+}
+
+// Select implements the Distributor interface.
+func (d *StableAssignmentDistributor) Select(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int) []*Bridge {
+	return d.selectAt(cfg, req, candidates, n, time.Now())
+}
+
+// selectAt selects bridges like Select, for the epoch that the given time
+// falls into.
+func (d *StableAssignmentDistributor) selectAt(cfg *ConfigFile, req *ClientRequest, candidates []*Bridge, n int, now time.Time) []*Bridge {
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	epochLength := cfg.GetOrgConfig(req.Organisation).AssignmentEpoch.Duration
+	epoch := now.UnixNano() / int64(epochLength)
+
+	ring := make([]ringEntry, len(candidates))
+	for i, b := range candidates {
+		position := Hmac(cfg, []byte(fmt.Sprintf("%d-bridge-%s", epoch, b.Fingerprint)))
+		ring[i] = ringEntry{position, b}
+	}
+	// Our HMACs are hex-encoded and of equal length, so sorting them as
+	// strings sorts them numerically.
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].position < ring[j].position
+	})
+
+	client := Hmac(cfg, []byte(fmt.Sprintf("%d-client-%q-%q-%q",
+		epoch, req.Organisation, req.Id, req.Location)))
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].position > client
+	})
+
+	var selected []*Bridge
+	for i := 0; i < len(ring) && i < n; i++ {
+		selected = append(selected, ring[(start+i)%len(ring)].bridge)
+	}
+	return selected
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// candidates returns the bridges in the given set as a slice.
+func candidates(bs *Bridges) []*Bridge {
+
+	var cs []*Bridge
+	for _, b := range bs.Bridges {
+		cs = append(cs, b)
+	}
+	return cs
+}
+
+func TestRoundRobinDistributor(t *testing.T) {
+
+	bs := newTestBridges("A", "B", "C")
+	d := &RoundRobinDistributor{}
+	req := &ClientRequest{Location: "ru"}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		for _, b := range d.Select(getConfig(), req, candidates(bs), 2) {
+			got = append(got, b.Fingerprint)
+		}
+	}
+	expected := []string{"A", "B", "C", "A"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d bridges but got %d.", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected bridges %v but got %v.", expected, got)
+			break
+		}
+	}
+
+	if len(d.Select(getConfig(), req, nil, 2)) != 0 {
+		t.Error("Selected bridges from empty set of candidates.")
+	}
+	if len(d.Select(getConfig(), req, candidates(bs), 0)) != 0 {
+		t.Error("Selected bridges even though we asked for none.")
+	}
+}
+
+func TestRandomByAgeDistributor(t *testing.T) {
+
+	now := time.Now()
+	bs := newTestBridges("A", "B", "C")
+	bs.Bridges["A"].FirstSeen = now.Add(-time.Hour)
+	bs.Bridges["B"].FirstSeen = now.Add(-100 * 24 * time.Hour)
+	bs.Bridges["C"].FirstSeen = now.Add(-200 * 24 * time.Hour)
+	d := &RandomByAgeDistributor{}
+	req := &ClientRequest{Location: "ru"}
+
+	if n := len(d.Select(getConfig(), req, candidates(bs), 5)); n != 3 {
+		t.Errorf("Expected 3 bridges but got %d.", n)
+	}
+
+	// Bridge A is new, so it should rarely get picked, and bridge C is twice
+	// as old as bridge B, so it should get picked about twice as often.
+	picked := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		picked[d.Select(getConfig(), req, candidates(bs), 1)[0].Fingerprint]++
+	}
+	if picked["A"] > 10 {
+		t.Errorf("Picked new bridge %d times out of 3000.", picked["A"])
+	}
+	if picked["C"] < picked["B"] {
+		t.Errorf("Picked old bridge less often than younger bridge: %v", picked)
+	}
+}
+
+func TestGetBridgesPools(t *testing.T) {
+
+	setConfig(&ConfigFile{
+		Organisations: map[string]*OrgConfig{
+			"foo": &OrgConfig{Pools: []string{DistributorMoat}},
+		},
+	})
+	bs := newTestBridges("unallocated", "moat")
+	bs.Bridges["moat"].Distributor = DistributorMoat
+	bridges.Update(bs)
+
+	ret, _ := GetBridges(getConfig(), &ClientRequest{Location: "ru", Organisation: "foo"}, 3)
+	if _, ok := ret.Bridges["moat"]; !ok || len(ret.Bridges) != 1 {
+		t.Error("Failed to hand out bridges from organisation's pool.")
+	}
+
+	ret, _ = GetBridges(getConfig(), &ClientRequest{Location: "ru", Organisation: "bar"}, 3)
+	if _, ok := ret.Bridges["unallocated"]; !ok || len(ret.Bridges) != 1 {
+		t.Error("Failed to hand out bridges from default pool.")
+	}
+
+	if _, err := NewDistributor("foo"); err == nil {
+		t.Error("Failed to reject unknown strategy.")
+	}
+}
+
+func TestStableAssignmentDistributor(t *testing.T) {
+
+	setConfig(&ConfigFile{MasterKey: "bogus master key"})
+	var fingerprints []string
+	for i := 0; i < 100; i++ {
+		fingerprints = append(fingerprints, fmt.Sprintf("%040d", i))
+	}
+	bs := newTestBridges(fingerprints...)
+	d := &StableAssignmentDistributor{}
+	req := &ClientRequest{Id: "1234", Location: "ru", Organisation: "foo"}
+
+	fingerprintsOf := func(bs []*Bridge) string {
+		var fs []string
+		for _, b := range bs {
+			fs = append(fs, b.Fingerprint)
+		}
+		sort.Strings(fs)
+		return strings.Join(fs, ",")
+	}
+
+	// Map iteration order randomises the order of our candidates.
+	first := fingerprintsOf(d.Select(getConfig(), req, candidates(bs), 3))
+	for i := 0; i < 10; i++ {
+		if fingerprintsOf(d.Select(getConfig(), req, candidates(bs), 3)) != first {
+			t.Fatal("Handed out different bridges to the same client.")
+		}
+	}
+
+	differs := false
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		other := &ClientRequest{Id: id, Location: "ru", Organisation: "foo"}
+		if fingerprintsOf(d.Select(getConfig(), other, candidates(bs), 3)) != first {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Error("Handed out the same bridges to all clients.")
+	}
+
+	// Assignments are stable within an epoch, and change with the next one.
+	epochLength := getConfig().GetOrgConfig(req.Organisation).AssignmentEpoch.Duration
+	start := time.Unix(0, 0).Add(1000 * epochLength)
+	inEpoch := fingerprintsOf(d.selectAt(getConfig(), req, candidates(bs), 3, start))
+	for _, offset := range []time.Duration{time.Nanosecond, epochLength / 2, epochLength - time.Nanosecond} {
+		if fingerprintsOf(d.selectAt(getConfig(), req, candidates(bs), 3, start.Add(offset))) != inEpoch {
+			t.Errorf("Assignment changed %s into the epoch.", offset)
+		}
+	}
+	if fingerprintsOf(d.selectAt(getConfig(), req, candidates(bs), 3, start.Add(epochLength))) == inEpoch {
+		t.Error("Assignment didn't change with the epoch.")
+	}
+
+	// Rotating our master key must result in new assignments.
+	setConfig(&ConfigFile{MasterKey: "another bogus master key"})
+	if fingerprintsOf(d.Select(getConfig(), req, candidates(bs), 3)) == first {
+		t.Error("Assignment didn't change with master key.")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	TokenSaltSize = 16
+	TokenIDSize   = 8
+)
+
+// ApiToken represents an authentication token that lets an organisation's
+// clients use our API.  We don't store the token itself but a salted hash of
+// it.  An organisation may have several tokens, which allows for rotating
+// tokens without downtime: add a new token, hand it to the organisation, and
+// let the old token expire.
+type ApiToken struct {
+	// ID identifies the token, e.g., when revoking it.  Unlike the token
+	// itself, the ID isn't secret.
+	ID           string `json:"id,omitempty"`
+	Organisation string `json:"organisation"`
+	// Token contains the token in plaintext.  It's only supported for
+	// backwards compatibility; use Salt and Hash instead.
+	Token string `json:"token,omitempty"`
+	// Salt and Hash contain the Base64-encoded salt and SHA-256 hash over the
+	// salt and the Base64-encoded token.
+	Salt string `json:"salt,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	// NotBefore and Expires optionally restrict the time span in which the
+	// token is valid.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	// Admin is set if the token grants access to our admin API, in addition
+	// to our regular API.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// hashToken returns the Base64-encoded SHA-256 hash over the given salt and
+// token.
+func hashToken(salt []byte, token string) string {
+
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// NewApiToken generates a new authentication token for the given organisation.
+// We return the token, which is to be handed to the organisation, and its
+// ApiToken object, which is to be added to our configuration file.
+func NewApiToken(organisation string) (string, *ApiToken, error) {
+
+	token, err := genNewToken()
+	if err != nil {
+		return "", nil, err
+	}
+	salt := make([]byte, TokenSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, TokenIDSize)
+	if _, err = rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	return token, &ApiToken{
+		ID:           hex.EncodeToString(id),
+		Organisation: organisation,
+		Salt:         base64.StdEncoding.EncodeToString(salt),
+		Hash:         hashToken(salt, token),
+	}, nil
+}
+
+// Validate returns an error if the token is unusable.
+func (t *ApiToken) Validate() error {
+
+	if t.NotBefore != nil && t.Expires != nil && !t.NotBefore.Before(*t.Expires) {
+		return errors.New("token expires before it becomes valid")
+	}
+	if t.Token != "" {
+		if t.Salt != "" || t.Hash != "" {
+			return errors.New("token must be given either in plaintext or as salted hash, but not both")
+		}
+		return nil
+	}
+	if t.Salt == "" || t.Hash == "" {
+		return errors.New("token has no salt or hash")
+	}
+	if _, err := base64.StdEncoding.DecodeString(t.Salt); err != nil {
+		return errors.New("salt is not Base64-encoded")
+	}
+	hash, err := base64.StdEncoding.DecodeString(t.Hash)
+	if err != nil || len(hash) != sha256.Size {
+		return errors.New("hash is not a Base64-encoded SHA-256 hash")
+	}
+	return nil
+}
+
+// IsActive returns 'true' if the token is valid at the given time.
+func (t *ApiToken) IsActive(now time.Time) bool {
+
+	if t.NotBefore != nil && now.Before(*t.NotBefore) {
+		return false
+	}
+	if t.Expires != nil && !now.Before(*t.Expires) {
+		return false
+	}
+	return true
+}
+
+// Matches returns 'true' if the given token matches our token.  The
+// comparison takes constant time.
+func (t *ApiToken) Matches(token string) bool {
+
+	if t.Token != "" {
+		return subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1
+	}
+	salt, err := base64.StdEncoding.DecodeString(t.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(salt, token))) == 1
+}
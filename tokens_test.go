@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApiToken(t *testing.T) {
+
+	token, apiToken, err := NewApiToken("foo")
+	if err != nil {
+		t.Fatalf("Failed to generate new token: %s", err)
+	}
+	if err = apiToken.Validate(); err != nil {
+		t.Fatalf("Generated invalid token: %s", err)
+	}
+	if apiToken.Token != "" {
+		t.Error("Generated token is stored in plaintext.")
+	}
+	if !apiToken.Matches(token) {
+		t.Error("Failed to match token.")
+	}
+	if apiToken.Matches(token[1:]) || apiToken.Matches("") {
+		t.Error("Matched invalid token.")
+	}
+
+	legacy := &ApiToken{Organisation: "foo", Token: "bar"}
+	if err = legacy.Validate(); err != nil {
+		t.Errorf("Rejected plaintext token: %s", err)
+	}
+	if !legacy.Matches("bar") || legacy.Matches("baz") {
+		t.Error("Failed to match plaintext token.")
+	}
+
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	if !apiToken.IsActive(now) {
+		t.Error("Token without time restrictions is inactive.")
+	}
+	apiToken.NotBefore = &future
+	if apiToken.IsActive(now) {
+		t.Error("Token is active before it becomes valid.")
+	}
+	apiToken.NotBefore, apiToken.Expires = &past, &now
+	if apiToken.IsActive(now) {
+		t.Error("Token is active after it expired.")
+	}
+	apiToken.Expires = &future
+	if !apiToken.IsActive(now) {
+		t.Error("Token is inactive during its validity period.")
+	}
+	apiToken.NotBefore, apiToken.Expires = &future, &past
+	if err = apiToken.Validate(); err == nil {
+		t.Error("Accepted token that expires before it becomes valid.")
+	}
+	legacy.NotBefore, legacy.Expires = &future, &past
+	if err = legacy.Validate(); err == nil {
+		t.Error("Accepted plaintext token that expires before it becomes valid.")
+	}
+}
+
+func TestGetApiToken(t *testing.T) {
+
+	oldToken, oldApiToken, _ := NewApiToken("foo")
+	newToken, newApiToken, _ := NewApiToken("foo")
+	expired := time.Now().Add(-time.Minute)
+	oldApiToken.Expires = &expired
+	setConfig(&ConfigFile{ApiTokens: []ApiToken{*oldApiToken, *newApiToken}})
+
+	if _, ok := getApiToken(getConfig(), oldToken); ok {
+		t.Error("Accepted expired token.")
+	}
+	if found, ok := getApiToken(getConfig(), newToken); !ok || found.Organisation != "foo" || found.ID != newApiToken.ID {
+		t.Error("Rejected valid token.")
+	}
+
+	// Disabling the token's organisation disables the token.
+	setConfig(&ConfigFile{
+		ApiTokens:     []ApiToken{*newApiToken},
+		Organisations: map[string]*OrgConfig{"foo": {Disabled: true}},
+	})
+	if _, ok := getApiToken(getConfig(), newToken); ok {
+		t.Error("Accepted token of disabled organisation.")
+	}
+}
@@ -21,6 +21,9 @@ type Transport struct {
 // NewTransport allocates and returns a new Transport object.
 func NewTransport() *Transport {
 	t := &Transport{}
+	// Pluggable transports that are listed in extra-info documents always run
+	// over TCP.
+	t.Protocol = ProtoTypeTCP
 	t.Parameters = make(map[string][]string)
 	return t
 }
@@ -37,6 +40,12 @@ func (t *Transport) String() string {
 		t.Type, t.Address.String(), t.Port, t.Fingerprint, strings.Join(args, ","))
 }
 
+// IsBlockedIn returns 'true' if the transport is blocked in the given country.
+// Like Bridge.IsBlockedIn, we only consider country-wide verdicts.
+func (t *Transport) IsBlockedIn(country string) bool {
+	return isBlockedIn(t.BlockedIn, country)
+}
+
 // Equals returns 'true' if the two given transports are identical, i.e., the
 // values in their respective structs are identical.
 func (t1 *Transport) Equals(t2 *Transport) bool {
@@ -45,10 +54,10 @@ func (t1 *Transport) Equals(t2 *Transport) bool {
 
 // GetID returns a unique ID that we derive from a transport's three-tuple
 // (i.e., its IP address, port, and protocol).  We derive the unique ID by
-// doing a HMAC (keyed with a master secret from our config file) over the
-// bridge's three-tuple.
-func (t *Transport) GetID() string {
+// doing a HMAC (keyed with the master secret from the given configuration)
+// over the bridge's three-tuple.
+func (t *Transport) GetID(cfg *ConfigFile) string {
 
 	threeTuple := fmt.Sprintf("%s-%d-%s", t.Address.String(), t.Port, t.Protocol)
-	return Hmac([]byte(threeTuple))
+	return Hmac(cfg, []byte(threeTuple))
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUsageWindow     = 7 * 24 * time.Hour
+	DefaultUsageMinReports = 3
+	DefaultUsageMinClients = 24
+	DefaultUsageDropRatio  = 0.25
+
+	// UsageRetention determines for how long we keep usage statistics, in
+	// multiples of the usage policy's window.
+	UsageRetention = 4
+)
+
+// usage holds the history of our bridges' usage statistics.
+var usage *UsageHistory
+
+// BridgeUsage represents the usage statistics that a bridge reports in its
+// extra-info descriptor, i.e., its 'bridge-stats-end' and 'bridge-ips' lines.
+type BridgeUsage struct {
+	// StatsEnd is the end of the interval that the statistics cover.
+	StatsEnd time.Time `json:"stats_end"`
+	// Interval is the length of the interval that the statistics cover.
+	Interval Duration `json:"interval"`
+	// Clients maps a lower-case country code to the (rounded up) number of
+	// unique IP addresses that connected to the bridge from the country.
+	Clients map[string]int `json:"clients"`
+}
+
+// UsagePolicy determines when we suspect a bridge to be blocked in a country
+// because its usage there collapsed.
+type UsagePolicy struct {
+	// Window determines how far back in time we consider a bridge's usage
+	// statistics to establish its usual usage in a country.
+	Window Duration `json:"window"`
+	// MinReports is the number of earlier reports within the window that we
+	// need before we judge a bridge's current usage.
+	MinReports int `json:"min_reports"`
+	// MinClients is the average number of clients per report from a country
+	// below which we don't judge the bridge's usage there.  Bridges round up
+	// their client counts to multiples of 8, so small numbers are noise.
+	MinClients float64 `json:"min_clients"`
+	// DropRatio is the fraction of its usual usage (in [0, 1]) at or below
+	// which we suspect a bridge to be blocked in a country.
+	DropRatio float64 `json:"drop_ratio"`
+}
+
+// GetUsagePolicy returns our usage policy, with defaults filled in for
+// settings that our configuration file lacks.
+func (c *ConfigFile) GetUsagePolicy() *UsagePolicy {
+
+	p := c.Usage
+	if p.Window.Duration <= 0 {
+		p.Window.Duration = DefaultUsageWindow
+	}
+	if p.MinReports <= 0 {
+		p.MinReports = DefaultUsageMinReports
+	}
+	if p.MinClients <= 0 {
+		p.MinClients = DefaultUsageMinClients
+	}
+	if p.DropRatio <= 0 || p.DropRatio > 1 {
+		p.DropRatio = DefaultUsageDropRatio
+	}
+	return &p
+}
+
+// UsageHistory stores our bridges' usage statistics over time in
+// wolpertinger's tables.
+type UsageHistory struct {
+	m  sync.Mutex
+	db *sql.DB
+}
+
+// NewUsageHistory allocates and returns a new UsageHistory object that is
+// backed by the given database.  The database's schema must be up to date;
+// see MigrateDatabase.
+func NewUsageHistory(db *sql.DB) *UsageHistory {
+	return &UsageHistory{db: db}
+}
+
+// Record stores the usage statistics of the given bridges, and discards
+// statistics older than UsageRetention windows.  We read the same statistics
+// on each reload, so we ignore statistics that we already have.
+func (h *UsageHistory) Record(bs *Bridges, policy *UsagePolicy, now time.Time) error {
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, b := range bs.Bridges {
+		u := b.Usage
+		if u == nil {
+			continue
+		}
+		_, err = tx.Exec(`INSERT OR IGNORE INTO WolpertingerBridgeStats
+			(fingerprint, stats_end, interval) VALUES (?, ?, ?);`,
+			b.Fingerprint, u.StatsEnd.Unix(), int64(u.Interval.Seconds()))
+		if err != nil {
+			return err
+		}
+		for country, clients := range u.Clients {
+			_, err = tx.Exec(`INSERT OR IGNORE INTO WolpertingerBridgeUsage
+				(fingerprint, stats_end, country, clients) VALUES (?, ?, ?, ?);`,
+				b.Fingerprint, u.StatsEnd.Unix(), country, clients)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cutoff := now.Add(-UsageRetention * policy.Window.Duration).Unix()
+	if _, err = tx.Exec("DELETE FROM WolpertingerBridgeStats WHERE stats_end < ?;", cutoff); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM WolpertingerBridgeUsage WHERE stats_end < ?;", cutoff); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// baseline represents a bridge's usage over its earlier reports.
+type baseline struct {
+	reports int
+	clients map[string]int
+}
+
+// ApplyTo sets the countries in which we suspect each of the given bridges to
+// be blocked: countries in which the bridge's current usage dropped to a
+// fraction of its average usage over its earlier reports.  Bridges without
+// current usage statistics aren't suspected anywhere.
+func (h *UsageHistory) ApplyTo(bs *Bridges, policy *UsagePolicy, now time.Time) error {
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	// We fetch a bit more than the window, so that the window of bridges
+	// whose current statistics are a little old is complete.
+	since := now.Add(-2 * policy.Window.Duration).Unix()
+	baselines := make(map[string]map[int64]*baseline)
+	get := func(fingerprint string, statsEnd int64) *baseline {
+		if _, ok := baselines[fingerprint]; !ok {
+			baselines[fingerprint] = make(map[int64]*baseline)
+		}
+		b, ok := baselines[fingerprint][statsEnd]
+		if !ok {
+			b = &baseline{clients: make(map[string]int)}
+			baselines[fingerprint][statsEnd] = b
+		}
+		return b
+	}
+
+	rows, err := h.db.Query(`SELECT fingerprint, stats_end FROM WolpertingerBridgeStats
+		WHERE stats_end >= ?;`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fingerprint string
+		var statsEnd int64
+		if err = rows.Scan(&fingerprint, &statsEnd); err != nil {
+			return err
+		}
+		get(fingerprint, statsEnd).reports = 1
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = h.db.Query(`SELECT fingerprint, stats_end, country, clients FROM WolpertingerBridgeUsage
+		WHERE stats_end >= ?;`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fingerprint, country string
+		var statsEnd int64
+		var clients int
+		if err = rows.Scan(&fingerprint, &statsEnd, &country, &clients); err != nil {
+			return err
+		}
+		get(fingerprint, statsEnd).clients[country] = clients
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for f, b := range bs.Bridges {
+		b.SuspectedBlockedIn = nil
+		if b.Usage == nil {
+			continue
+		}
+		b.SuspectedBlockedIn = suspectedCountries(b.Usage, baselines[f], policy)
+	}
+	return nil
+}
+
+// suspectedCountries returns the sorted countries in which the given current
+// usage statistics dropped compared to the given earlier reports, which are
+// keyed by the UNIX time at which they end.
+func suspectedCountries(current *BridgeUsage, reports map[int64]*baseline, policy *UsagePolicy) []string {
+
+	end := current.StatsEnd.Unix()
+	start := current.StatsEnd.Add(-policy.Window.Duration).Unix()
+
+	total := &baseline{clients: make(map[string]int)}
+	for statsEnd, r := range reports {
+		if statsEnd >= end || statsEnd < start {
+			continue
+		}
+		total.reports += r.reports
+		for country, clients := range r.clients {
+			total.clients[country] += clients
+		}
+	}
+	if total.reports < policy.MinReports {
+		return nil
+	}
+
+	var countries []string
+	for country, clients := range total.clients {
+		// Reports that don't mention a country count as zero clients from
+		// there.
+		average := float64(clients) / float64(total.reports)
+		if average < policy.MinClients {
+			continue
+		}
+		if float64(current.Clients[country]) <= average*policy.DropRatio {
+			countries = append(countries, country)
+		}
+	}
+	sort.Strings(countries)
+	return countries
+}
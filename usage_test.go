@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUsageHistory(t *testing.T) {
+
+	db := openTestDB(t)
+	defer db.Close()
+	h := NewUsageHistory(db)
+	policy := (&ConfigFile{}).GetUsagePolicy()
+
+	fingerprint := "A0EC5B0FC51A5CD800B9D1D16D325636B5755BCE"
+	bs := newTestBridges(fingerprint)
+	b := bs.Bridges[fingerprint]
+	start := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	// The bridge has many users in Iran and Germany, and a few in Russia.
+	for day := 0; day < 4; day++ {
+		b.Usage = &BridgeUsage{
+			StatsEnd: start.Add(time.Duration(day) * 24 * time.Hour),
+			Interval: Duration{24 * time.Hour},
+			Clients:  map[string]int{"ir": 800, "de": 96, "ru": 8},
+		}
+		now := b.Usage.StatsEnd.Add(time.Hour)
+		if err := h.Record(bs, policy, now); err != nil {
+			t.Fatalf("failed to record usage statistics: %s", err)
+		}
+		// We record the same statistics on each reload.
+		if err := h.Record(bs, policy, now); err != nil {
+			t.Fatalf("failed to record usage statistics again: %s", err)
+		}
+		if err := h.ApplyTo(bs, policy, now); err != nil {
+			t.Fatalf("failed to apply usage statistics: %s", err)
+		}
+		if len(b.SuspectedBlockedIn) != 0 {
+			t.Errorf("suspected bridge to be blocked in %v despite steady usage", b.SuspectedBlockedIn)
+		}
+	}
+
+	// Now, the bridge's users from Iran and Russia are gone.  Russia doesn't
+	// count because the bridge never had many users there.
+	b.Usage = &BridgeUsage{
+		StatsEnd: start.Add(4 * 24 * time.Hour),
+		Interval: Duration{24 * time.Hour},
+		Clients:  map[string]int{"de": 88},
+	}
+	now := b.Usage.StatsEnd.Add(time.Hour)
+	if err := h.Record(bs, policy, now); err != nil {
+		t.Fatalf("failed to record usage statistics: %s", err)
+	}
+	if err := h.ApplyTo(bs, policy, now); err != nil {
+		t.Fatalf("failed to apply usage statistics: %s", err)
+	}
+	if !reflect.DeepEqual(b.SuspectedBlockedIn, []string{"ir"}) {
+		t.Errorf("expected bridge to be suspected blocked in [ir] but got %v", b.SuspectedBlockedIn)
+	}
+
+	// Bridges without statistics aren't suspected anywhere.
+	b.Usage = nil
+	if err := h.ApplyTo(bs, policy, now); err != nil {
+		t.Fatalf("failed to apply usage statistics: %s", err)
+	}
+	if len(b.SuspectedBlockedIn) != 0 {
+		t.Errorf("suspected bridge without statistics to be blocked in %v", b.SuspectedBlockedIn)
+	}
+
+	// We discard old statistics.
+	if err := h.Record(bs, policy, now.Add(UsageRetention*policy.Window.Duration)); err != nil {
+		t.Fatalf("failed to prune usage statistics: %s", err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM WolpertingerBridgeStats;").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected old statistics to be discarded but %d remain", count)
+	}
+}
+
+func TestSuspectedCountriesNeedsHistory(t *testing.T) {
+
+	policy := (&ConfigFile{}).GetUsagePolicy()
+	end := time.Date(2020, 12, 3, 0, 0, 0, 0, time.UTC)
+	reports := map[int64]*baseline{
+		end.Add(-24 * time.Hour).Unix(): &baseline{1, map[string]int{"ir": 800}},
+		end.Add(-48 * time.Hour).Unix(): &baseline{1, map[string]int{"ir": 800}},
+	}
+	current := &BridgeUsage{StatsEnd: end, Clients: map[string]int{}}
+	if cs := suspectedCountries(current, reports, policy); len(cs) != 0 {
+		t.Errorf("suspected blocking with only %d earlier reports", len(reports))
+	}
+	reports[end.Add(-72*time.Hour).Unix()] = &baseline{1, map[string]int{"ir": 800}}
+	if cs := suspectedCountries(current, reports, policy); !reflect.DeepEqual(cs, []string{"ir"}) {
+		t.Errorf("expected suspected blocking in [ir] but got %v", cs)
+	}
+}
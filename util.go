@@ -4,14 +4,41 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"time"
 )
 
 // Hmac calculates and returns a HMAC-SHA256 over the provided data.  The key
-// is from our configuration file.
-func Hmac(data []byte) string {
+// is the master key from the given configuration.
+func Hmac(cfg *ConfigFile, data []byte) string {
 
-	h := hmac.New(sha256.New, []byte(config.MasterKey))
+	h := hmac.New(sha256.New, []byte(cfg.MasterKey))
 	h.Write([]byte(data))
 
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// Duration embeds time.Duration.  The only difference to time.Duration is that
+// we implement JSON (un)marshalling methods, which allow us to write durations
+// as strings like "72h" in our configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
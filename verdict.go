@@ -0,0 +1,218 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	DefaultVerdictWindow       = 7 * 24 * time.Hour
+	DefaultVerdictMinProbes    = 3
+	DefaultVerdictFailureRatio = 0.8
+	DefaultControlWindow       = time.Hour
+	DefaultRequireControl      = true
+)
+
+// VerdictPolicy determines when we consider a bridge (or one of its
+// transports) blocked in a location.
+type VerdictPolicy struct {
+	// Window determines how far back in time we consider probe results.
+	Window Duration `json:"window"`
+	// MinProbes is the number of independent probes (i.e., probes with
+	// distinct client IDs within distinct organisations) that must have
+	// tested a bridge from a location before we reach a verdict.
+	MinProbes int `json:"min_probes"`
+	// FailureRatio is the fraction of failed tests (in [0, 1]) from a location
+	// at or above which we consider a bridge blocked there.
+	FailureRatio float64 `json:"failure_ratio"`
+	// ControlWindow determines how far apart in time a failed test and a
+	// control measurement of the same bridge may be for the control
+	// measurement to tell us if the bridge was online during the test.
+	ControlWindow Duration `json:"control_window"`
+	// RequireControl is set if we only count a failed test as censorship if a
+	// control measurement succeeded within the control window.  Otherwise,
+	// we only discard failed tests for which all control measurements within
+	// the control window failed too.  If unset, it defaults to
+	// DefaultRequireControl.
+	RequireControl *bool `json:"require_control"`
+}
+
+// GetVerdictPolicy returns our verdict policy, with defaults filled in for
+// settings that our configuration file lacks.
+func (c *ConfigFile) GetVerdictPolicy() *VerdictPolicy {
+
+	p := c.Verdict
+	if p.Window.Duration <= 0 {
+		p.Window.Duration = DefaultVerdictWindow
+	}
+	if p.MinProbes <= 0 {
+		p.MinProbes = DefaultVerdictMinProbes
+	}
+	if p.FailureRatio <= 0 || p.FailureRatio > 1 {
+		p.FailureRatio = DefaultVerdictFailureRatio
+	}
+	if p.ControlWindow.Duration <= 0 {
+		p.ControlWindow.Duration = DefaultControlWindow
+	}
+	if p.RequireControl == nil {
+		requireControl := DefaultRequireControl
+		p.RequireControl = &requireControl
+	}
+	return &p
+}
+
+// requiresControl returns 'true' if we only count a failed test as censorship
+// if a control measurement succeeded around the time of the test.
+func (p *VerdictPolicy) requiresControl() bool {
+
+	if p.RequireControl == nil {
+		return DefaultRequireControl
+	}
+	return *p.RequireControl
+}
+
+// target identifies what a probe result is about: a bridge's vanilla ORPort
+// or one of its transports.
+type target struct {
+	Fingerprint string
+	Transport   string
+}
+
+// verdictKey identifies a target in a location.
+type verdictKey struct {
+	target
+	Location Location
+}
+
+// tally keeps track of a target's test results in a location.
+type tally struct {
+	probes   map[string]bool
+	failures int
+	total    int
+}
+
+// probeKey returns the key by which we tell apart independent probes.  Client
+// IDs are chosen by the client, so we only trust them to be unique within the
+// organisation whose token the client used.
+func probeKey(r *Result) string {
+
+	return r.Organisation + "\x00" + r.ClientID
+}
+
+// resultLocations returns the locations that the given result counts towards:
+// the client's country and, if known, the client's autonomous system.
+func resultLocations(r *Result) []Location {
+
+	ls := []Location{Location{Country: r.Country}}
+	if r.ASN != 0 {
+		ls = append(ls, Location{ASN: r.ASN})
+	}
+	return ls
+}
+
+// controls holds a target's control measurements, ordered by time.
+type controls []*Result
+
+// around returns whether any of the control measurements within the given
+// distance of the given time succeeded, and whether any of them failed.
+func (cs controls) around(t time.Time, distance time.Duration) (succeeded, failed bool) {
+
+	i := sort.Search(len(cs), func(i int) bool {
+		return !cs[i].Time.Before(t.Add(-distance))
+	})
+	for ; i < len(cs) && !cs[i].Time.After(t.Add(distance)); i++ {
+		if cs[i].Reachable {
+			succeeded = true
+		} else {
+			failed = true
+		}
+	}
+	return
+}
+
+// isCensorship returns 'true' if we should count the given failed test as
+// censorship rather than the bridge being offline, based on the control
+// measurements of the test's target.
+func isCensorship(r *Result, cs controls, policy *VerdictPolicy) bool {
+
+	succeeded, failed := cs.around(r.Time, policy.ControlWindow.Duration)
+	if succeeded {
+		return true
+	}
+	if failed || policy.requiresControl() {
+		return false
+	}
+	return true
+}
+
+// ComputeVerdicts aggregates the given probe results and returns, for each
+// target, the locations in which we consider the target blocked.  A target is
+// blocked in a location if enough independent probes tested it from there,
+// and enough of these tests failed.  Successes from a location therefore
+// clear a verdict once they push the failure ratio below the policy's
+// threshold.  Control measurements don't count towards any location; we use
+// them to discard failed tests that happened while the bridge was offline.
+// The caller is responsible for only passing results that fall into the
+// policy's window.
+func ComputeVerdicts(rs []*Result, policy *VerdictPolicy) map[target][]*Location {
+
+	ctrls := make(map[target]controls)
+	for _, r := range rs {
+		if r.Control {
+			tgt := target{r.Fingerprint, r.Transport}
+			ctrls[tgt] = append(ctrls[tgt], r)
+		}
+	}
+	for _, cs := range ctrls {
+		sort.SliceStable(cs, func(i, j int) bool {
+			return cs[i].Time.Before(cs[j].Time)
+		})
+	}
+
+	tallies := make(map[verdictKey]*tally)
+	for _, r := range rs {
+		if r.Control {
+			continue
+		}
+		if !r.Reachable && !isCensorship(r, ctrls[target{r.Fingerprint, r.Transport}], policy) {
+			continue
+		}
+		for _, l := range resultLocations(r) {
+			k := verdictKey{target{r.Fingerprint, r.Transport}, l}
+			t, ok := tallies[k]
+			if !ok {
+				t = &tally{probes: make(map[string]bool)}
+				tallies[k] = t
+			}
+			t.probes[probeKey(r)] = true
+			t.total++
+			if !r.Reachable {
+				t.failures++
+			}
+		}
+	}
+
+	verdicts := make(map[target][]*Location)
+	for k, t := range tallies {
+		if len(t.probes) < policy.MinProbes {
+			continue
+		}
+		if float64(t.failures)/float64(t.total) < policy.FailureRatio {
+			continue
+		}
+		l := k.Location
+		verdicts[k.target] = append(verdicts[k.target], &l)
+	}
+
+	// Sort locations, so our verdicts don't depend on map iteration order.
+	for _, ls := range verdicts {
+		sort.Slice(ls, func(i, j int) bool {
+			if ls[i].Country != ls[j].Country {
+				return ls[i].Country < ls[j].Country
+			}
+			return ls[i].ASN < ls[j].ASN
+		})
+	}
+
+	return verdicts
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeVerdicts(t *testing.T) {
+
+	requireControl := false
+	policy := &VerdictPolicy{MinProbes: 2, FailureRatio: 0.5, RequireControl: &requireControl}
+	tgt := target{"A", BridgeTypeVanilla}
+	result := func(clientID, country string, asn int, reachable bool) *Result {
+		return &Result{
+			Fingerprint: tgt.Fingerprint,
+			Transport:   tgt.Transport,
+			ClientID:    clientID,
+			Country:     country,
+			ASN:         asn,
+			Reachable:   reachable,
+		}
+	}
+
+	// A single probe mustn't suffice, no matter how often it fails.
+	rs := []*Result{
+		result("1", "ru", 1234, false),
+		result("1", "ru", 1234, false),
+	}
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 0 {
+		t.Error("Reached verdict based on a single probe.")
+	}
+
+	rs = append(rs, result("2", "ru", 4321, false))
+	verdicts := ComputeVerdicts(rs, policy)[tgt]
+	if len(verdicts) != 1 || verdicts[0].Country != "ru" || verdicts[0].ASN != 0 {
+		t.Fatalf("Failed to consider bridge blocked in Russia: %v", verdicts)
+	}
+
+	// Probes in Iran can reach the bridge.
+	rs = append(rs, result("3", "ir", 0, true), result("4", "ir", 0, true))
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 1 {
+		t.Error("Considered bridge blocked in a country where it's reachable.")
+	}
+
+	// Two different probes in the same AS.
+	rs = append(rs, result("5", "ru", 1234, false))
+	verdicts = ComputeVerdicts(rs, policy)[tgt]
+	// Locations are sorted by country code, and AS locations have none.
+	if len(verdicts) != 2 || verdicts[0].ASN != 1234 || verdicts[1].Country != "ru" {
+		t.Errorf("Failed to consider bridge blocked in AS1234: %v", verdicts)
+	}
+
+	// Client IDs only tell apart probes within an organisation.
+	orgs := []*Result{result("1", "cn", 0, false), result("1", "cn", 0, false)}
+	orgs[0].Organisation, orgs[1].Organisation = "foo", "bar"
+	if len(ComputeVerdicts(orgs, policy)[tgt]) != 1 {
+		t.Error("Counted probes of different organisations as a single probe.")
+	}
+	orgs[1].Organisation = "foo"
+	if len(ComputeVerdicts(orgs, policy)[tgt]) != 0 {
+		t.Error("Counted a single probe of an organisation as two probes.")
+	}
+
+	// Once enough successes come back, the verdict must clear.
+	for _, id := range []string{"6", "7", "8", "9", "10"} {
+		rs = append(rs, result(id, "ru", 0, true))
+	}
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 1 {
+		t.Error("Failed to clear verdict for Russia after successes came back.")
+	}
+}
+
+func TestComputeVerdictsWithControls(t *testing.T) {
+
+	now := time.Now()
+	policy := &VerdictPolicy{MinProbes: 1, FailureRatio: 0.5, ControlWindow: Duration{time.Hour}}
+	tgt := target{"A", BridgeTypeObfs4}
+	result := func(country string, reachable, control bool, when time.Time) *Result {
+		return &Result{
+			Fingerprint: tgt.Fingerprint,
+			Transport:   tgt.Transport,
+			ClientID:    "1",
+			Country:     country,
+			Reachable:   reachable,
+			Control:     control,
+			Time:        when,
+		}
+	}
+
+	// The bridge was offline when the probe in Russia tested it.
+	rs := []*Result{
+		result("ru", false, false, now),
+		result("de", false, true, now.Add(-10*time.Minute)),
+	}
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 0 {
+		t.Error("Counted failure as censorship even though the control failed too.")
+	}
+
+	// A successful control measurement, but too long after the test.
+	rs = append(rs, result("de", true, true, now.Add(2*time.Hour)))
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 0 {
+		t.Error("Counted failure as censorship based on unrelated control.")
+	}
+
+	// A successful control measurement right after the test.
+	rs = append(rs, result("de", true, true, now.Add(5*time.Minute)))
+	verdicts := ComputeVerdicts(rs, policy)[tgt]
+	if len(verdicts) != 1 || verdicts[0].Country != "ru" {
+		t.Errorf("Failed to count failure as censorship: %v", verdicts)
+	}
+
+	// Without any control measurements, we only count failures if we don't
+	// require controls, which we do by default.
+	rs = []*Result{result("ru", false, false, now)}
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 0 {
+		t.Error("Counted failure as censorship despite lack of control.")
+	}
+	requireControl := false
+	policy.RequireControl = &requireControl
+	if len(ComputeVerdicts(rs, policy)[tgt]) != 1 {
+		t.Error("Failed to count failure without control as censorship.")
+	}
+}
+
+func TestGetVerdictPolicy(t *testing.T) {
+
+	if p := (&ConfigFile{}).GetVerdictPolicy(); !p.requiresControl() || p.MinProbes != DefaultVerdictMinProbes {
+		t.Errorf("Failed to fill in default verdict policy: %+v", p)
+	}
+	requireControl := false
+	c := &ConfigFile{Verdict: VerdictPolicy{RequireControl: &requireControl}}
+	if c.GetVerdictPolicy().requiresControl() {
+		t.Error("Overrode explicitly disabled require_control.")
+	}
+}
@@ -1,49 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
 	AuthTokenSize = 32
-)
-
-var config ConfigFile
-
-type ConfigFile struct {
-	MasterKey     string     `json:"master_key"`
-	ApiTokens     []ApiToken `json:"api_tokens"`
-	SqliteFile    string     `json:"sqlite_file"`
-	ExtrainfoFile string     `json:"extrainfo_file"`
-}
-
-type ApiToken struct {
-	Organisation string `json:"organisation"`
-	Token        string `json:"token"`
-}
-
-// loadConfigFile loads our JSON-encoded configuration file from disk.
-func loadConfigFile(filename string) error {
-
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-
-	if err = json.Unmarshal(content, &config); err != nil {
-		return err
-	}
 
-	return nil
-}
+	// ShutdownTimeout determines how long we wait for requests in flight to
+	// finish when shutting down.
+	ShutdownTimeout = 30 * time.Second
+)
 
 // genNewToken generates and returns a new authentication token.
 func genNewToken() (string, error) {
@@ -58,11 +37,24 @@ func genNewToken() (string, error) {
 
 func main() {
 
+	// Subcommands (e.g., "wolpertinger token add") have their own flags.
+	if len(os.Args) > 1 {
+		if _, ok := subcommands[os.Args[1]]; ok {
+			if err := runSubcommand(os.Args[1:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var addr string
 	var certFilename, keyFilename string
 	var configFilename string
 	var logFilename string
 	var newToken bool
+	var organisation string
+	var exportFormat string
 
 	flag.StringVar(&addr, "addr", ":7000", "Address to listen on.")
 	flag.StringVar(&certFilename, "cert", "", "TLS certificate file.")
@@ -70,6 +62,8 @@ func main() {
 	flag.StringVar(&configFilename, "config", "", "Configuration file.")
 	flag.StringVar(&logFilename, "log", "", "Log file.")
 	flag.BoolVar(&newToken, "new-token", false, "Generate a new authentication token.")
+	flag.StringVar(&organisation, "organisation", "ORGANISATION", "Organisation to use in the config snippet of -new-token.")
+	flag.StringVar(&exportFormat, "export-blocked", "", "Write blocked bridges to stdout in the given format (\"json\" or \"bridgedb\"), and exit.")
 	flag.Parse()
 
 	if logFilename != "" {
@@ -82,37 +76,131 @@ func main() {
 	}
 
 	if newToken {
-		token, err := genNewToken()
+		token, apiToken, err := NewApiToken(organisation)
 		if err != nil {
 			log.Fatalf("Failed to generate new authentication token: %s", err.Error())
 		}
+		snippet, err := json.MarshalIndent(apiToken, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to marshal authentication token: %s", err.Error())
+		}
 		fmt.Printf("Authentication token: %s\n", token)
+		fmt.Printf("Add the following to the \"api_tokens\" list in your config file:\n%s\n", snippet)
 		return
 	}
 
 	if configFilename == "" {
 		log.Fatal("No configuration file given.")
 	} else {
-		if err := loadConfigFile(configFilename); err != nil {
+		c, err := loadConfigFile(configFilename)
+		if err != nil {
 			log.Fatalf("Failed to load config file: %s", err)
 		}
+		setConfig(c)
+	}
+
+	db, err := OpenDatabase(getConfig().SqliteFile)
+	if err != nil {
+		log.Fatalf("Failed to open SQLite database: %s", err)
+	}
+	defer db.Close()
+	if err = CheckBridgeDBSchema(db); err != nil {
+		log.Fatalf("Unexpected schema of BridgeDB's database: %s", err)
+	}
+	results = NewResults(db)
+	limiter = NewLimiter(db)
+	usage = NewUsageHistory(db)
+
+	if exportFormat != "" {
+		bs, _, err := loadBridges(context.Background(), false)
+		if err != nil {
+			log.Fatalf("Failed to load bridges: %s", err)
+		}
+		if err = WriteBlockedBridges(os.Stdout, GetBlockedBridges(bs), exportFormat); err != nil {
+			log.Fatalf("Failed to export blocked bridges: %s", err)
+		}
+		return
 	}
 
-	// (Re-)load bridges periodically.  We wait for this function to finish its
-	// first run before proceeding to start our web service.
-	done := make(chan bool)
-	defer close(done)
-	go bridges.ReloadBridges(done)
-	<-done
+	// We stop reloading our configuration and bridges, and shut down our web
+	// service, once we receive a SIGTERM or SIGINT.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	// Reload bridges on demand when we receive a SIGUSR1.  We register the
+	// handler before our first reload, so an early SIGUSR1 doesn't kill us.
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for range sigusr1 {
+			log.Printf("Received SIGUSR1; reloading bridges.")
+			reloader.Trigger()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		watchConfigFile(ctx, configFilename)
+	}()
+
+	// (Re-)load bridges periodically.  Our web service starts right away, so
+	// monitoring tools can reach our health endpoints, but the API only
+	// serves requests once the first reload (periodic or on demand)
+	// succeeded.
+	loaded := reloader.Loaded()
+	go func() {
+		defer wg.Done()
+		reloader.Run(ctx)
+	}()
 
 	mux := http.NewServeMux()
-	mux.Handle("/bridges", http.HandlerFunc(BridgesHandler))
+	mux.Handle("/bridges", instrument("bridges", requireLoaded(loaded, http.HandlerFunc(BridgesHandler))))
+	mux.Handle("/results", instrument("results", requireLoaded(loaded, http.HandlerFunc(ResultsHandler))))
+	mux.Handle("/blocked", instrument("blocked", requireLoaded(loaded, http.HandlerFunc(BlockedHandler))))
+	mux.Handle("/admin/reload", instrument("admin", http.HandlerFunc(AdminReloadHandler)))
+	mux.Handle(adminBridgesPrefix, instrument("admin", requireLoaded(loaded, http.HandlerFunc(AdminBridgeHandler))))
+	mux.Handle("/metrics", http.HandlerFunc(MetricsHandler))
+	mux.Handle("/healthz", http.HandlerFunc(HealthzHandler))
+	mux.Handle("/readyz", http.HandlerFunc(ReadyzHandler))
 	mux.Handle("/", http.HandlerFunc(IndexHandler))
 
-	log.Printf("Starting service on %s.", addr)
-	if certFilename != "" && keyFilename != "" {
-		log.Fatal(http.ListenAndServeTLS(addr, certFilename, keyFilename, mux))
-	} else {
-		log.Fatal(http.ListenAndServe(addr, mux))
+	server := &http.Server{Addr: addr, Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting service on %s.", addr)
+		if certFilename != "" && keyFilename != "" {
+			serverErr <- server.ListenAndServeTLS(certFilename, keyFilename)
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	var failure error
+	select {
+	case failure = <-serverErr:
+		log.Printf("Web service failed: %s", failure)
+	case sig := <-stop:
+		log.Printf("Received %s; shutting down.", sig)
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ShutdownTimeout)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down web service gracefully: %s", err)
+		}
+		cancelShutdown()
+	}
+
+	// Cancel a reload that may be in progress, and wait for it to return, so
+	// we don't close our database underneath it.
+	cancel()
+	wg.Wait()
+	auditLog.Close()
+	if failure != nil {
+		// Let our supervisor know that something went wrong.
+		db.Close()
+		log.Fatal("Shut down after failure of web service.")
 	}
+	log.Printf("Shut down.")
 }